@@ -2,20 +2,28 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"speedtest-exporter/internal/app_info"
+	"speedtest-exporter/internal/bandwidth_budget"
 	"speedtest-exporter/internal/bandwidth_observer"
+	"speedtest-exporter/internal/config"
+	"speedtest-exporter/internal/connection_tracer"
 	"speedtest-exporter/internal/exporter"
+	"speedtest-exporter/internal/icmp_ping"
+	"speedtest-exporter/internal/result_store"
+	"sync"
 	"syscall"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -36,21 +44,137 @@ func newHealthCheckHandler() http.Handler {
 	})
 }
 
-func main() {
-	debug := flag.Bool("debug", false, "sets log level to debug")
-	gracefulShutdown := flag.Bool("graceful-shutdown", true, "allow in flight speed tests to finish before shutting down")
-	gracefulShutdownTimeout := flag.Duration("graceful-shutdown-timeout", 10*time.Second, "graceful shutdown timeout")
-	testTimeout := flag.Duration("test-timeout", 1*time.Minute, "timeout for speedtest runs")
-	testInterval := flag.Duration("test-interval", 1*time.Hour, "interval between speedtest runs")
-	goCollector := flag.Bool("gocollector", false, "enables go stats exporter")
-	processCollector := flag.Bool("processcollector", false, "enables process stats exporter")
-	savingMode := flag.Bool("saving-mode", false, "enables saving mode in speedtest-go to reduce bandwidth usage at the cost of accuracy")
-	flag.Parse()
+// exporterOpts returns the exporter options set by cfg, which must be valid.
+func exporterOpts(cfg *config.Config) exporter.Opts {
+	schedule, err := cfg.Scheduler()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid test schedule")
+	}
+	ispRules, err := cfg.ISPRules()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid ISP policies")
+	}
+	return exporter.Opts{
+		TestTimeout:  cfg.Test.Timeout,
+		TestInterval: cfg.Test.Interval,
+		Schedule:     schedule,
+		SavingMode:   cfg.Test.SavingMode,
+		ServerIDs:    cfg.Servers.IDs,
+		ServerCount:  cfg.Servers.Count,
+		ResultMaxAge: cfg.ResultMaxAge,
+		TestMode:     cfg.Test.Mode,
+		TestMinAge:   cfg.Test.MinAge,
+
+		PacketLossDuration: cfg.Test.PacketLossDuration,
+		PingMode:           cfg.Test.PingMode,
+		PingCount:          cfg.Test.PingCount,
+		Phases:             cfg.Test.Phases,
+		ISPRules:           ispRules,
+		MetricSchema:       cfg.MetricSchema,
+		ServerLabels:       cfg.Servers.Labels,
+	}
+}
+
+// checkPingMode returns an error if the exporter can't ping servers in mode.
+func checkPingMode(mode exporter.PingMode) error {
+	if mode != exporter.PingModeICMP {
+		return nil
+	}
+	return icmp_ping.Check()
+}
 
+func setLogLevel(debug bool) {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	if *debug {
+	if debug {
 		zerolog.SetGlobalLevel(zerolog.DebugLevel)
 	}
+}
+
+// reloader re-reads the config file, and applies it to the running exporter.
+type reloader struct {
+	args []string
+	ex   *exporter.SpeedtestExporter
+	cfg  *config.Config
+	mut  sync.Mutex
+}
+
+func (r *reloader) Reload() error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	cfg, err := config.Parse(app_name, r.args)
+	if err != nil {
+		return err
+	}
+	if err := checkPingMode(cfg.Test.PingMode); err != nil {
+		return err
+	}
+	if changed := r.cfg.StaticChanges(cfg); len(changed) > 0 {
+		log.Warn().Strs("options", changed).Msg("Changes to these options take effect on restart")
+	}
+	setLogLevel(cfg.Debug)
+	r.ex.Reload(exporterOpts(cfg))
+	r.cfg = cfg
+	log.Info().Interface("config", cfg.Values()).Msg("Reloaded config")
+	return nil
+}
+
+func (r *reloader) Config() *config.Config {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.cfg
+}
+
+func newReloadHandler(r *reloader) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.Reload(); err != nil {
+			log.Error().Err(err).Msg("Failed to reload config")
+			http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+func main() {
+	cfg, err := config.Parse(app_name, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
+	setLogLevel(cfg.Debug)
+	if err := checkPingMode(cfg.Test.PingMode); err != nil {
+		log.Fatal().Err(err).Msg("Ping mode unavailable")
+	}
+
+	retention := result_store.Retention{MaxAge: cfg.History.MaxAge, MaxCount: cfg.History.MaxCount}
+	store := result_store.NewMemoryStore(retention)
+	if cfg.History.File != "" {
+		store, err = result_store.NewFileStore(cfg.History.File, retention)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.History.File).Msg("Failed to open history file")
+		}
+	}
+	defer store.Close()
+
+	var budget *bandwidth_budget.Budget
+	if cfg.BandwidthBudget.Limit > 0 {
+		budget, err = bandwidth_budget.New(bandwidth_budget.Opts{
+			Limit:           cfg.BandwidthBudget.Limit,
+			Period:          cfg.BandwidthBudget.Period,
+			SavingThreshold: cfg.BandwidthBudget.SavingThreshold,
+			File:            cfg.BandwidthBudget.File,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.BandwidthBudget.File).Msg("Failed to load bandwidth budget")
+		}
+	}
 
 	var srv http.Server
 
@@ -58,18 +182,55 @@ func main() {
 	exporterCtx, exporterCancel := context.WithCancel(context.Background())
 	defer exporterCancel()
 
+	log.Info().
+		Str("app_name", app_name).
+		Str("version", version).
+		Msg("Exporter Started.")
+	log.Info().Interface("config", cfg.Values()).Msg("Effective configuration")
+
+	appFunc := app_info.GaugeFunc(app_info.Opts{
+		Namespace: "speedtest_exporter",
+		Name:      app_name,
+		Version:   version,
+	})
+	tracer := connection_tracer.New(connection_tracer.Opts{
+		Transport: http.DefaultTransport,
+	})
+	bw := bandwidth_observer.New(bandwidth_observer.Opts{
+		Transport:    tracer,
+		MetricSchema: cfg.MetricSchema,
+	})
+	opts := exporterOpts(cfg)
+	opts.Ctx = exporterCtx
+	opts.Doer = &http.Client{Transport: bw}
+	opts.Store = store
+	opts.Budget = budget
+	opts.ExportClientIP = cfg.ClientInfo.IP
+	ex := exporter.New(opts)
+	configReloader := &reloader{args: os.Args[1:], ex: ex, cfg: cfg}
+
 	go func() {
 		sigchan := make(chan os.Signal, 1)
 
 		signal.Notify(sigchan, os.Interrupt)
 		signal.Notify(sigchan, syscall.SIGTERM)
-		sig := <-sigchan
+		signal.Notify(sigchan, syscall.SIGHUP)
+		var sig os.Signal
+		for sig = range sigchan {
+			if sig != syscall.SIGHUP {
+				break
+			}
+			if err := configReloader.Reload(); err != nil {
+				log.Error().Err(err).Msg("Failed to reload config")
+			}
+		}
 		log.Info().
 			Str("signal", sig.String()).
 			Msg("Stopping in response to signal")
-		ctx, cancel := context.WithTimeout(context.Background(), *gracefulShutdownTimeout)
+		shutdown := configReloader.Config().GracefulShutdown
+		ctx, cancel := context.WithTimeout(context.Background(), shutdown.Timeout)
 		defer cancel()
-		if !*gracefulShutdown {
+		if !shutdown.Enabled {
 			log.Info().Msg("Canceling all in flight speed tests")
 			exporterCancel()
 		}
@@ -79,45 +240,45 @@ func main() {
 		close(idleConnsClosed)
 	}()
 
-	log.Info().
-		Str("app_name", app_name).
-		Str("version", version).
-		Msg("Exporter Started.")
-
-	appFunc := app_info.GaugeFunc(app_info.Opts{
-		Namespace: "speedtest_exporter",
-		Name:      app_name,
-		Version:   version,
-	})
-	bw := bandwidth_observer.New(http.DefaultTransport)
-	ex := exporter.New(exporter.Opts{
-		Ctx:          exporterCtx,
-		TestTimeout:  *testTimeout,
-		TestInterval: *testInterval,
-		Doer:         &http.Client{Transport: bw},
-		SavingMode:   *savingMode,
-	})
-
-	go func() {
-		log.Debug().Msg("Starting Result Update Thread")
-		ex.TestLoop()
-	}()
+	if cfg.Test.Mode == exporter.TestModeInterval {
+		go func() {
+			log.Debug().Msg("Starting Result Update Thread")
+			ex.TestLoop()
+		}()
+	}
 
 	reg := prometheus.NewPedanticRegistry()
-	reg.MustRegister(appFunc, ex, bw)
+	reg.MustRegister(appFunc, ex, bw, tracer)
 
-	if *goCollector {
+	if cfg.Collectors.Go {
 		reg.MustRegister(collectors.NewGoCollector())
 	}
-	if *processCollector {
+	if cfg.Collectors.Process {
 		reg.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	}
 	router := http.NewServeMux()
 	router.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	router.Handle("/probe", ex.ProbeHandler())
+	router.Handle("/api/v1/results/latest", ex.LatestResultsHandler())
+	router.Handle("/api/v1/results", ex.ResultsHandler())
+	if cfg.API.Token != "" {
+		router.Handle("/api/v1/run", ex.RunHandler(cfg.API.Token))
+	}
+	if cfg.Web.EnableLifecycle {
+		router.Handle("/-/reload", newReloadHandler(configReloader))
+	}
 	router.Handle("/healthz", newHealthCheckHandler())
-	srv.Addr = ":8080"
 	srv.Handler = router
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+	systemdSocket := false
+	webFlags := &web.FlagConfig{
+		WebListenAddresses: &[]string{cfg.Web.ListenAddress},
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &cfg.Web.ConfigFile,
+	}
+	// TLS certificates and basic auth users are re-read from the web config
+	// file as connections and requests arrive, so changes apply without a
+	// reload.
+	if err := web.ListenAndServe(&srv, webFlags, slog.New(zerolog.NewSlogHandler(log.Logger))); err != http.ErrServerClosed {
 		log.Fatal().Err(err).Msg("Failed to start HTTP Server")
 	}
 	<-idleConnsClosed
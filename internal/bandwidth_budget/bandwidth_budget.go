@@ -0,0 +1,226 @@
+package bandwidth_budget
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Period is how often a Budget's usage resets.
+type Period string
+
+const (
+	// PeriodDaily resets at midnight, local time.
+	PeriodDaily Period = "daily"
+	// PeriodMonthly resets at midnight on the first of the month, local time.
+	PeriodMonthly Period = "monthly"
+)
+
+// ParsePeriod parses a Period from its string representation.
+func ParsePeriod(s string) (Period, error) {
+	switch period := Period(s); period {
+	case PeriodDaily, PeriodMonthly:
+		return period, nil
+	}
+	return "", fmt.Errorf("unknown budget period %q", s)
+}
+
+func (p Period) MarshalText() ([]byte, error) {
+	return []byte(p), nil
+}
+
+func (p *Period) UnmarshalText(text []byte) error {
+	period, err := ParsePeriod(string(text))
+	if err != nil {
+		return err
+	}
+	*p = period
+	return nil
+}
+
+// start returns the start of the period containing t.
+func (p Period) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	if p == PeriodMonthly {
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Decision is how a run should be carried out to stay within a Budget.
+type Decision int
+
+const (
+	// DecisionRun runs as configured.
+	DecisionRun Decision = iota
+	// DecisionSaving runs in saving mode, as the budget is nearly used up.
+	DecisionSaving
+	// DecisionSkip skips the run, as it would exceed the budget.
+	DecisionSkip
+)
+
+func (d Decision) String() string {
+	switch d {
+	case DecisionSaving:
+		return "saving"
+	case DecisionSkip:
+		return "skip"
+	}
+	return "run"
+}
+
+type Opts struct {
+	// Limit is the number of bytes speedtests may transfer per period.
+	Limit Bytes
+	// Period is how often usage resets. Defaults to PeriodMonthly.
+	Period Period
+	// SavingThreshold is the fraction of Limit remaining, from 0 to 1, below
+	// which runs switch to saving mode.
+	SavingThreshold float64
+	// File, if set, persists usage so it survives restarts.
+	File string
+}
+
+// Budget tracks the bytes transferred by speedtests against a limit per
+// period, and decides whether runs may go ahead.
+type Budget struct {
+	opts  Opts
+	state state
+	mut   sync.Mutex
+	now   func() time.Time
+}
+
+// state is the usage in the current period, as persisted to Opts.File.
+type state struct {
+	PeriodStart time.Time `json:"period_start"`
+	Used        int64     `json:"used"`
+	// PerServer and SavingPerServer are the bytes transferred testing a
+	// single server in the last run in normal and saving mode, used to
+	// estimate the cost of the next run.
+	PerServer       int64 `json:"per_server"`
+	SavingPerServer int64 `json:"saving_per_server"`
+}
+
+// New returns a Budget, restoring usage from opts.File if it exists.
+func New(opts Opts) (*Budget, error) {
+	if opts.Period == "" {
+		opts.Period = PeriodMonthly
+	}
+	b := &Budget{
+		opts: opts,
+		now:  time.Now,
+	}
+	b.state.PeriodStart = opts.Period.start(b.now())
+	if opts.File == "" {
+		return b, nil
+	}
+	data, err := os.ReadFile(opts.File)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bandwidth budget: %w", err)
+	}
+	if err := json.Unmarshal(data, &b.state); err != nil {
+		return nil, fmt.Errorf("failed to parse bandwidth budget %s: %w", opts.File, err)
+	}
+	return b, nil
+}
+
+// rollover resets usage if the period has ended. Callers must hold the lock.
+func (b *Budget) rollover() {
+	start := b.opts.Period.start(b.now())
+	if !start.Equal(b.state.PeriodStart) {
+		b.state.PeriodStart = start
+		b.state.Used = 0
+	}
+}
+
+// Remaining returns the bytes left in the current period, which is negative
+// if the budget has been overrun.
+func (b *Budget) Remaining() int64 {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.rollover()
+	return int64(b.opts.Limit) - b.state.Used
+}
+
+// Decide decides how a run testing the given number of servers should be
+// carried out. savingMode is whether the run is already in saving mode.
+func (b *Budget) Decide(servers int, savingMode bool) Decision {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.rollover()
+	remaining := int64(b.opts.Limit) - b.state.Used
+	if remaining <= 0 {
+		return DecisionSkip
+	}
+	// Until a run in either mode has been recorded, its cost is unknown, so
+	// it's allowed to go ahead as long as the budget isn't used up.
+	savingFits := remaining >= b.state.SavingPerServer*int64(servers)
+	if savingMode {
+		if !savingFits {
+			return DecisionSkip
+		}
+		return DecisionRun
+	}
+	// Runs switch to saving mode below the threshold, or when a normal run
+	// wouldn't fit but a saving mode one would.
+	if float64(remaining) < b.opts.SavingThreshold*float64(b.opts.Limit) ||
+		remaining < b.state.PerServer*int64(servers) {
+		if !savingFits {
+			return DecisionSkip
+		}
+		return DecisionSaving
+	}
+	return DecisionRun
+}
+
+// Record adds the bytes transferred by a run testing the given number of
+// servers to the usage.
+func (b *Budget) Record(bytes int64, servers int, savingMode bool) {
+	b.mut.Lock()
+	defer b.mut.Unlock()
+	b.rollover()
+	b.state.Used += bytes
+	if servers > 0 {
+		if savingMode {
+			b.state.SavingPerServer = bytes / int64(servers)
+		} else {
+			b.state.PerServer = bytes / int64(servers)
+		}
+	}
+	if err := b.save(); err != nil {
+		log.Warn().Err(err).Str("path", b.opts.File).Msg("Failed to persist bandwidth budget")
+	}
+}
+
+// save atomically writes the state to the budget's file, if any. Callers must
+// hold the lock.
+func (b *Budget) save() error {
+	if b.opts.File == "" {
+		return nil
+	}
+	data, err := json.Marshal(b.state)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.opts.File), filepath.Base(b.opts.File)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.opts.File)
+}
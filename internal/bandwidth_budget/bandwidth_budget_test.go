@@ -0,0 +1,145 @@
+package bandwidth_budget
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Bytes
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"1234", 1234, false},
+		{"50GB", 50e9, false},
+		{"50 gb", 50e9, false},
+		{"1.5GiB", 3 << 29, false},
+		{"10MiB", 10 << 20, false},
+		{"1TB", 1e12, false},
+		{"512B", 512, false},
+		{"lots", 0, true},
+		{"GB", 0, true},
+		{"-1GB", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseBytes(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestBytesString(t *testing.T) {
+	assert.Equal(t, "0", Bytes(0).String())
+	assert.Equal(t, "50GB", Bytes(50e9).String())
+	assert.Equal(t, "1536MiB", Bytes(3<<29).String())
+	assert.Equal(t, "1001B", Bytes(1001).String())
+}
+
+func newTestBudget(t *testing.T, opts Opts, now *time.Time) *Budget {
+	t.Helper()
+	b, err := New(opts)
+	require.NoError(t, err)
+	b.now = func() time.Time { return *now }
+	b.state.PeriodStart = opts.Period.start(*now)
+	return b
+}
+
+func TestDecide(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local)
+	b := newTestBudget(t, Opts{Limit: 1000, Period: PeriodMonthly, SavingThreshold: 0.25}, &now)
+
+	// nothing is known about the cost of a run yet
+	assert.Equal(DecisionRun, b.Decide(1, false))
+	b.Record(500, 2, false)
+	assert.Equal(int64(500), b.Remaining())
+	// two servers cost 500 bytes, so one fits in what's left
+	assert.Equal(DecisionRun, b.Decide(1, false))
+	// above the threshold, three don't, but saving mode's cost isn't known yet
+	assert.Equal(DecisionSaving, b.Decide(3, false))
+
+	b.Record(300, 1, false)
+	// below the saving threshold, with no estimate for saving mode yet
+	assert.Equal(DecisionSaving, b.Decide(1, false))
+	b.Record(100, 1, true)
+	assert.Equal(DecisionSaving, b.Decide(1, false))
+	assert.Equal(DecisionRun, b.Decide(1, true))
+	// a saving mode run against two servers costs more than is left
+	assert.Equal(DecisionSkip, b.Decide(2, false))
+
+	b.Record(100, 1, true)
+	assert.Equal(int64(0), b.Remaining())
+	assert.Equal(DecisionSkip, b.Decide(1, true))
+
+	// usage resets at the start of the next month
+	now = time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local)
+	assert.Equal(int64(1000), b.Remaining())
+	assert.Equal(DecisionRun, b.Decide(1, false))
+}
+
+func TestDecideSavingFits(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local)
+	b := newTestBudget(t, Opts{Limit: 1000, Period: PeriodMonthly, SavingThreshold: 0.25}, &now)
+	b.Record(300, 1, false)
+	b.Record(100, 1, true)
+	assert.Equal(int64(600), b.Remaining())
+
+	// above the threshold, a normal run against three servers is too large,
+	// but a saving mode one fits
+	assert.Equal(DecisionSaving, b.Decide(3, false))
+	assert.Equal(DecisionRun, b.Decide(3, true))
+	// a normal run against two servers still fits
+	assert.Equal(DecisionRun, b.Decide(2, false))
+	// and neither fits against seven
+	assert.Equal(DecisionSkip, b.Decide(7, false))
+	assert.Equal(DecisionSkip, b.Decide(7, true))
+}
+
+func TestDailyPeriod(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Date(2024, 1, 15, 23, 0, 0, 0, time.Local)
+	b := newTestBudget(t, Opts{Limit: 1000, Period: PeriodDaily}, &now)
+	b.Record(1000, 1, false)
+	assert.Equal(DecisionSkip, b.Decide(1, false))
+	now = now.Add(time.Hour)
+	assert.Equal(DecisionRun, b.Decide(1, false))
+}
+
+func TestPersistence(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "budget.json")
+	opts := Opts{Limit: 1000, File: path}
+
+	b, err := New(opts)
+	require.NoError(t, err)
+	b.Record(400, 1, false)
+
+	restored, err := New(opts)
+	require.NoError(t, err)
+	assert.Equal(int64(600), restored.Remaining())
+	assert.Equal(int64(400), restored.state.PerServer)
+	// two more servers would take 800 bytes, so only a saving mode run, whose
+	// cost isn't known yet, may go ahead
+	assert.Equal(DecisionSaving, restored.Decide(2, false))
+}
+
+func TestParsePeriod(t *testing.T) {
+	period, err := ParsePeriod("daily")
+	require.NoError(t, err)
+	assert.Equal(t, PeriodDaily, period)
+	_, err = ParsePeriod("weekly")
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+package bandwidth_budget
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bytes is a number of bytes, which parses from and formats to a
+// human-readable size such as 50GB or 1.5GiB.
+type Bytes int64
+
+// byteUnits are ordered from largest to smallest, so sizes format in the
+// largest unit which divides them exactly.
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TiB", 1 << 40},
+	{"TB", 1e12},
+	{"GiB", 1 << 30},
+	{"GB", 1e9},
+	{"MiB", 1 << 20},
+	{"MB", 1e6},
+	{"KiB", 1 << 10},
+	{"KB", 1e3},
+	{"B", 1},
+}
+
+// ParseBytes parses a size, which is either a plain number of bytes, or a
+// number followed by one of the units B, KB, MB, GB and TB, which are powers
+// of 1000, or KiB, MiB, GiB and TiB, which are powers of 1024.
+func ParseBytes(s string) (Bytes, error) {
+	trimmed := strings.TrimSpace(s)
+	number, unit := trimmed, int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToLower(trimmed), strings.ToLower(u.suffix)) {
+			number, unit = strings.TrimSpace(trimmed[:len(trimmed)-len(u.suffix)]), u.size
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if value < 0 {
+		return 0, fmt.Errorf("invalid size %q, must not be negative", s)
+	}
+	return Bytes(value * float64(unit)), nil
+}
+
+func (b Bytes) String() string {
+	if b == 0 {
+		return "0"
+	}
+	for _, u := range byteUnits {
+		if int64(b)%u.size == 0 {
+			return strconv.FormatInt(int64(b)/u.size, 10) + u.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// Set implements flag.Value.
+func (b *Bytes) Set(s string) error {
+	parsed, err := ParseBytes(s)
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+func (b Bytes) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+func (b *Bytes) UnmarshalText(text []byte) error {
+	return b.Set(string(text))
+}
@@ -1,79 +1,170 @@
 package bandwidth_observer
 
 import (
+	"io"
 	"net/http"
+	"speedtest-exporter/internal/metric_schema"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/rs/zerolog/log"
 )
 
+// BandwidthObserver is an http.RoundTripper which counts the bytes
+// transferred in request and response bodies. Bodies are counted as they're
+// streamed, so bodies of unknown length and partial transfers, e.g. from
+// cancelled tests, are counted accurately. In the v2 metric schema, bytes are
+// labelled by host and method. In both schemas, bytes are also attributed to
+// the server ID and phase the request is tagged with.
 type BandwidthObserver struct {
-	T                  http.RoundTripper
-	bytesUploaded      prometheus.Counter
-	bytesDownloaded    prometheus.Counter
+	T               http.RoundTripper
+	labelled        bool
+	bytesUploaded   *prometheus.CounterVec
+	bytesDownloaded *prometheus.CounterVec
+	// phaseBytes counts bytes by direction, and the server ID and phase the
+	// request is tagged with.
+	phaseBytes *prometheus.CounterVec
+	// unknownContentSize counts the bodies of unknown length, for v1
+	// compatibility. It's nil in v2.
 	unknownContentSize prometheus.Counter
 }
 
-func New(T http.RoundTripper) *BandwidthObserver {
-	if T == nil {
-		T = http.DefaultTransport
+type Opts struct {
+	// Transport is the RoundTripper whose traffic is observed. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+	// MetricSchema selects the names of exported metrics. Defaults to
+	// metric_schema.V1.
+	MetricSchema metric_schema.Schema
+}
+
+func New(opts Opts) *BandwidthObserver {
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport
 	}
-	return &BandwidthObserver{
-		T: T,
-		bytesUploaded: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "speedtest_bytes_uploaded",
-			Help: "Total bytes uploaded",
-		}),
-		bytesDownloaded: prometheus.NewCounter(prometheus.CounterOpts{
-			Name: "speedtest_bytes_downloaded",
-			Help: "Total bytes downloaded",
-		}),
-		unknownContentSize: prometheus.NewCounter(prometheus.CounterOpts{
+	// v1 counters predate the _total suffix convention, and aren't labelled.
+	suffix := ""
+	var labels []string
+	var unknownContentSize prometheus.Counter
+	if opts.MetricSchema == metric_schema.V2 {
+		suffix = "_total"
+		labels = []string{"host", "method"}
+	} else {
+		unknownContentSize = prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "speedtest_unknown_content_size",
 			Help: "Total number of times the content size was unknown",
-		}),
+		})
+	}
+	b := &BandwidthObserver{
+		T:        opts.Transport,
+		labelled: labels != nil,
+		bytesUploaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "speedtest_bytes_uploaded" + suffix,
+			Help: "Total bytes uploaded",
+		}, labels),
+		bytesDownloaded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "speedtest_bytes_downloaded" + suffix,
+			Help: "Total bytes downloaded",
+		}, labels),
+		phaseBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "speedtest_phase_bytes_total",
+			Help: "Total bytes transferred, by the server and phase of the speedtest run which caused them",
+		}, []string{"direction", "server_id", "phase"}),
+		unknownContentSize: unknownContentSize,
+	}
+	if !b.labelled {
+		// Export the unlabelled counters from the start, as v1 always has.
+		b.bytesUploaded.WithLabelValues()
+		b.bytesDownloaded.WithLabelValues()
+	}
+	return b
+}
+
+// labelValues returns the values of the byte counters' labels for req.
+func (b *BandwidthObserver) labelValues(req *http.Request) []string {
+	if !b.labelled {
+		return nil
+	}
+	return []string{req.URL.Host, req.Method}
+}
+
+// countUnknownSize counts a body of unknown length, in v1.
+func (b *BandwidthObserver) countUnknownSize(contentLength int64) {
+	if b.unknownContentSize != nil && contentLength <= 0 {
+		b.unknownContentSize.Inc()
 	}
 }
 
 func (b *BandwidthObserver) RoundTrip(req *http.Request) (*http.Response, error) {
+	tags := TagsFrom(req.Context())
+	labels := b.labelValues(req)
+	if req.Body != nil && req.Body != http.NoBody {
+		b.countUnknownSize(req.ContentLength)
+		// RoundTrippers mustn't modify the request, so count the body of a
+		// shallow copy. The body is counted as the transport reads it, so
+		// bytes sent before a request fails are counted too.
+		counted := *req
+		uploaded := b.bytesUploaded.WithLabelValues(labels...)
+		phaseUploaded := b.phaseBytes.WithLabelValues("upload", tags.ServerID, tags.Phase)
+		counted.Body = &countingReader{
+			ReadCloser: req.Body,
+			add: func(n int) {
+				uploaded.Add(float64(n))
+				phaseUploaded.Add(float64(n))
+				if tags.Usage != nil {
+					tags.Usage.uploaded.Add(int64(n))
+				}
+			},
+		}
+		req = &counted
+	}
 	resp, err := b.T.RoundTrip(req)
 	if err != nil {
 		return resp, err
 	}
-	if req.ContentLength > 0 {
-		if req.Body == nil {
-			log.Debug().Msg("Ghosts in the Machine!")
-		}
-		b.bytesUploaded.Add(float64(req.ContentLength))
-	} else if req.Body != nil {
-		log.Debug().
-			Int64("content-length", req.ContentLength).
-			Str("method", req.Method).
-			Str("url", req.URL.String()).
-			Msg("unknown request content size")
-		b.unknownContentSize.Inc()
+	b.countUnknownSize(resp.ContentLength)
+	downloaded := b.bytesDownloaded.WithLabelValues(labels...)
+	phaseDownloaded := b.phaseBytes.WithLabelValues("download", tags.ServerID, tags.Phase)
+	resp.Body = &countingReader{
+		ReadCloser: resp.Body,
+		add: func(n int) {
+			downloaded.Add(float64(n))
+			phaseDownloaded.Add(float64(n))
+			if tags.Usage != nil {
+				tags.Usage.downloaded.Add(int64(n))
+			}
+		},
 	}
-	if resp.ContentLength > 0 {
-		b.bytesDownloaded.Add(float64(resp.ContentLength))
-	} else {
-		b.unknownContentSize.Inc()
-		log.Debug().
-			Int64("content-length", req.ContentLength).
-			Str("method", req.Method).
-			Str("url", req.URL.String()).
-			Msg("unknown response content size")
+	return resp, nil
+}
+
+// countingReader calls add with the number of bytes of each read from an
+// io.ReadCloser.
+type countingReader struct {
+	io.ReadCloser
+	add func(n int)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.add(n)
 	}
-	return resp, err
+	return n, err
 }
 
 func (b *BandwidthObserver) Describe(ch chan<- *prometheus.Desc) {
-	ch <- b.bytesUploaded.Desc()
-	ch <- b.bytesDownloaded.Desc()
-	ch <- b.unknownContentSize.Desc()
+	b.bytesUploaded.Describe(ch)
+	b.bytesDownloaded.Describe(ch)
+	b.phaseBytes.Describe(ch)
+	if b.unknownContentSize != nil {
+		ch <- b.unknownContentSize.Desc()
+	}
 }
 
 func (b *BandwidthObserver) Collect(ch chan<- prometheus.Metric) {
-	ch <- b.bytesUploaded
-	ch <- b.bytesDownloaded
-	ch <- b.unknownContentSize
+	b.bytesUploaded.Collect(ch)
+	b.bytesDownloaded.Collect(ch)
+	b.phaseBytes.Collect(ch)
+	if b.unknownContentSize != nil {
+		ch <- b.unknownContentSize
+	}
 }
@@ -0,0 +1,191 @@
+package bandwidth_observer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"speedtest-exporter/internal/metric_schema"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		// Flushing before writing the body forces a chunked response, whose
+		// length isn't known up front.
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	tests := []struct {
+		desc         string
+		method       string
+		body         io.Reader
+		wantUploaded float64
+	}{
+		{"get", http.MethodGet, nil, 0},
+		{"post", http.MethodPost, strings.NewReader(strings.Repeat("y", 500)), 500},
+		// Without a known length, the request body is sent chunked.
+		{"post_unknown_length", http.MethodPost, io.MultiReader(strings.NewReader(strings.Repeat("z", 300))), 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			b := New(Opts{MetricSchema: metric_schema.V2})
+			client := &http.Client{Transport: b}
+
+			req, err := http.NewRequest(tt.method, srv.URL, tt.body)
+			require.NoError(t, err)
+			resp, err := client.Do(req)
+			require.NoError(t, err)
+			_, err = io.Copy(io.Discard, resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			assert.Equal(1000.0, testutil.ToFloat64(b.bytesDownloaded.WithLabelValues(host, tt.method)))
+			assert.Equal(tt.wantUploaded, testutil.ToFloat64(b.bytesUploaded.WithLabelValues(host, tt.method)))
+		})
+	}
+}
+
+func TestRoundTripPartialTransfer(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+	b := New(Opts{MetricSchema: metric_schema.V2})
+	client := &http.Client{Transport: b}
+
+	// only part of the response is read before the test is cancelled
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	_, err = io.CopyN(io.Discard, resp.Body, 100)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(100.0, testutil.ToFloat64(b.bytesDownloaded.WithLabelValues(srv.Listener.Addr().String(), http.MethodGet)))
+
+	// the upload is counted even though the request fails
+	failing := New(Opts{MetricSchema: metric_schema.V2, Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		_, _ = io.CopyN(io.Discard, req.Body, 200)
+		return nil, errors.New("connection reset")
+	})})
+	req, err := http.NewRequest(http.MethodPost, "http://speedtest.example.net/upload", strings.NewReader(strings.Repeat("y", 1000)))
+	require.NoError(t, err)
+	_, err = failing.RoundTrip(req)
+	assert.Error(err)
+	assert.Equal(200.0, testutil.ToFloat64(failing.bytesUploaded.WithLabelValues("speedtest.example.net", http.MethodPost)))
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRoundTripDoesNotModifyRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	b := New(Opts{MetricSchema: metric_schema.V2})
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+	body := io.NopCloser(strings.NewReader("body"))
+	req := &http.Request{Method: http.MethodPost, URL: u, Body: body, Header: http.Header{}}
+	resp, err := b.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, body, req.Body)
+}
+
+func TestRoundTripTags(t *testing.T) {
+	assert := assert.New(t)
+	b := New(Opts{MetricSchema: metric_schema.V2, Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		_, _ = io.Copy(io.Discard, req.Body)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("response"))}, nil
+	})})
+
+	usage := &Usage{}
+	ctx := WithUsage(context.Background(), usage)
+	ctx = WithServerID(ctx, "1234")
+	for _, phase := range []string{"download", "upload"} {
+		req, err := http.NewRequestWithContext(WithPhase(ctx, phase), http.MethodPost, "http://speedtest.example.net/upload.php", strings.NewReader("request"))
+		require.NoError(t, err)
+		resp, err := b.RoundTrip(req)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	for _, phase := range []string{"download", "upload"} {
+		assert.Equal(8.0, testutil.ToFloat64(b.phaseBytes.WithLabelValues("download", "1234", phase)))
+		assert.Equal(7.0, testutil.ToFloat64(b.phaseBytes.WithLabelValues("upload", "1234", phase)))
+	}
+	assert.Equal(16.0, testutil.ToFloat64(b.bytesDownloaded.WithLabelValues("speedtest.example.net", http.MethodPost)))
+	assert.Equal(14.0, testutil.ToFloat64(b.bytesUploaded.WithLabelValues("speedtest.example.net", http.MethodPost)))
+	assert.Equal(int64(16), usage.Downloaded())
+	assert.Equal(int64(14), usage.Uploaded())
+
+	// tags are layered, so setting one keeps the others
+	tags := TagsFrom(WithPhase(ctx, "ping"))
+	assert.Equal(Tags{ServerID: "1234", Phase: "ping", Usage: usage}, tags)
+	assert.Equal(Tags{}, TagsFrom(context.Background()))
+}
+
+func TestRoundTripV1(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, strings.Repeat("x", 1000))
+	}))
+	defer srv.Close()
+	b := New(Opts{})
+	// v1 exports unlabelled counters, even before any traffic
+	assert.NoError(testutil.CollectAndCompare(b, strings.NewReader(`
+# HELP speedtest_bytes_downloaded Total bytes downloaded
+# TYPE speedtest_bytes_downloaded counter
+speedtest_bytes_downloaded 0
+# HELP speedtest_bytes_uploaded Total bytes uploaded
+# TYPE speedtest_bytes_uploaded counter
+speedtest_bytes_uploaded 0
+# HELP speedtest_unknown_content_size Total number of times the content size was unknown
+# TYPE speedtest_unknown_content_size counter
+speedtest_unknown_content_size 0
+`)))
+
+	client := &http.Client{Transport: b}
+	req, err := http.NewRequestWithContext(WithPhase(context.Background(), "upload"), http.MethodPost, srv.URL, strings.NewReader(strings.Repeat("y", 500)))
+	require.NoError(t, err)
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// the chunked response's length wasn't known up front
+	assert.NoError(testutil.CollectAndCompare(b, strings.NewReader(`
+# HELP speedtest_bytes_downloaded Total bytes downloaded
+# TYPE speedtest_bytes_downloaded counter
+speedtest_bytes_downloaded 1000
+# HELP speedtest_bytes_uploaded Total bytes uploaded
+# TYPE speedtest_bytes_uploaded counter
+speedtest_bytes_uploaded 500
+# HELP speedtest_unknown_content_size Total number of times the content size was unknown
+# TYPE speedtest_unknown_content_size counter
+speedtest_unknown_content_size 1
+`), "speedtest_bytes_downloaded", "speedtest_bytes_uploaded", "speedtest_unknown_content_size"))
+	// but still attributes bytes to phases
+	assert.Equal(500.0, testutil.ToFloat64(b.phaseBytes.WithLabelValues("upload", "", "upload")))
+	assert.Equal(1000.0, testutil.ToFloat64(b.phaseBytes.WithLabelValues("download", "", "upload")))
+}
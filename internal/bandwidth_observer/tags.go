@@ -0,0 +1,62 @@
+package bandwidth_observer
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Tags attribute the traffic of requests to the speedtest server and phase
+// which caused it. Requests are tagged via their context.
+type Tags struct {
+	ServerID string
+	Phase    string
+	// Usage, if set, accumulates the bytes transferred by tagged requests.
+	Usage *Usage
+}
+
+// Usage accumulates the bytes transferred by requests, e.g. over a single
+// speedtest run.
+type Usage struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+}
+
+func (u *Usage) Uploaded() int64 {
+	return u.uploaded.Load()
+}
+
+func (u *Usage) Downloaded() int64 {
+	return u.downloaded.Load()
+}
+
+type tagsKey struct{}
+
+// TagsFrom returns the tags of ctx, which are empty if it has none.
+func TagsFrom(ctx context.Context) Tags {
+	tags, _ := ctx.Value(tagsKey{}).(Tags)
+	return tags
+}
+
+func withTags(ctx context.Context, update func(*Tags)) context.Context {
+	tags := TagsFrom(ctx)
+	update(&tags)
+	return context.WithValue(ctx, tagsKey{}, tags)
+}
+
+// WithServerID tags requests made with the returned context with a speedtest
+// server ID, keeping any other tags of ctx.
+func WithServerID(ctx context.Context, serverID string) context.Context {
+	return withTags(ctx, func(t *Tags) { t.ServerID = serverID })
+}
+
+// WithPhase tags requests made with the returned context with a phase of a
+// speedtest run, keeping any other tags of ctx.
+func WithPhase(ctx context.Context, phase string) context.Context {
+	return withTags(ctx, func(t *Tags) { t.Phase = phase })
+}
+
+// WithUsage accumulates the bytes transferred by requests made with the
+// returned context in usage, keeping any other tags of ctx.
+func WithUsage(ctx context.Context, usage *Usage) context.Context {
+	return withTags(ctx, func(t *Tags) { t.Usage = usage })
+}
@@ -0,0 +1,574 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"speedtest-exporter/internal/bandwidth_budget"
+	"speedtest-exporter/internal/exporter"
+	"speedtest-exporter/internal/metric_schema"
+	"speedtest-exporter/internal/scheduler"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"go.yaml.in/yaml/v3"
+)
+
+// Config is the configuration of the exporter. It's built from defaults, an
+// optional YAML config file, environment variables and command line flags, in
+// increasing order of precedence.
+type Config struct {
+	Debug            bool             `yaml:"debug"`
+	Web              WebConfig        `yaml:"web"`
+	GracefulShutdown GracefulShutdown `yaml:"graceful_shutdown"`
+	Test             TestConfig       `yaml:"test"`
+	Servers          ServersConfig    `yaml:"servers"`
+	// ResultMaxAge is how long the last successful result is exported for
+	// when subsequent runs fail. Zero keeps it indefinitely.
+	ResultMaxAge    time.Duration         `yaml:"result_max_age"`
+	MetricSchema    metric_schema.Schema  `yaml:"metric_schema"`
+	Collectors      CollectorsConfig      `yaml:"collectors"`
+	History         HistoryConfig         `yaml:"history"`
+	API             APIConfig             `yaml:"api"`
+	BandwidthBudget BandwidthBudgetConfig `yaml:"bandwidth_budget"`
+	ClientInfo      ClientInfoConfig      `yaml:"client_info"`
+	// ISPPolicies adjust how speedtests are run on matching ISPs. They can
+	// only be set in the config file.
+	ISPPolicies []ISPPolicyConfig `yaml:"isp_policies"`
+}
+
+type WebConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+	// ConfigFile is the path to an exporter-toolkit web config file, which
+	// configures TLS and basic auth.
+	ConfigFile string `yaml:"config_file"`
+	// EnableLifecycle serves /-/reload, which reloads the config file.
+	EnableLifecycle bool `yaml:"enable_lifecycle"`
+}
+
+type GracefulShutdown struct {
+	// Enabled allows in flight speedtests to finish before shutting down.
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type TestConfig struct {
+	Mode     exporter.TestMode `yaml:"mode"`
+	Interval time.Duration     `yaml:"interval"`
+	// Schedule is a cron expression which, if set, overrides Interval.
+	Schedule string `yaml:"schedule"`
+	// Splay is the maximum random delay added to each scheduled run.
+	Splay time.Duration `yaml:"splay"`
+	// Blackouts are daily windows of local time in which no runs are
+	// scheduled.
+	Blackouts []scheduler.Window `yaml:"blackouts"`
+	Timeout   time.Duration      `yaml:"timeout"`
+	// MinAge is, in scrape mode, the minimum age of the last run before a
+	// scrape triggers a new one.
+	MinAge             time.Duration `yaml:"min_age"`
+	SavingMode         bool          `yaml:"saving_mode"`
+	PacketLossDuration time.Duration `yaml:"packet_loss_duration"`
+	// PingMode selects how server latency is measured.
+	PingMode exporter.PingMode `yaml:"ping_mode"`
+	// PingCount is the number of pings sent to each server.
+	PingCount int `yaml:"ping_count"`
+	// Phases are the phases of each speedtest to run.
+	Phases exporter.TestPhases `yaml:"phases"`
+}
+
+type ServersConfig struct {
+	// IDs pins the speedtest servers to test against.
+	IDs []int `yaml:"ids"`
+	// Count is the number of closest servers to test against when no servers
+	// are pinned.
+	Count int `yaml:"count"`
+	// Labels are the labels identifying servers on per-server metrics. When
+	// empty, the metric schema's default is used.
+	Labels []string `yaml:"labels"`
+}
+
+type CollectorsConfig struct {
+	Go      bool `yaml:"go"`
+	Process bool `yaml:"process"`
+}
+
+type HistoryConfig struct {
+	File     string        `yaml:"file"`
+	MaxAge   time.Duration `yaml:"max_age"`
+	MaxCount int           `yaml:"max_count"`
+}
+
+type APIConfig struct {
+	// Token is the bearer token required to trigger runs via the API.
+	Token string `yaml:"token"`
+}
+
+type BandwidthBudgetConfig struct {
+	// Limit is the number of bytes speedtests may transfer per period. Zero
+	// disables the budget.
+	Limit  bandwidth_budget.Bytes  `yaml:"limit"`
+	Period bandwidth_budget.Period `yaml:"period"`
+	// SavingThreshold is the fraction of the limit remaining below which runs
+	// switch to saving mode.
+	SavingThreshold float64 `yaml:"saving_threshold"`
+	// File persists usage across restarts.
+	File string `yaml:"file"`
+}
+
+type ClientInfoConfig struct {
+	// IP adds the client's public IP address to speedtest_client_info.
+	IP bool `yaml:"ip"`
+}
+
+type ISPPolicyConfig struct {
+	// ISP is a regular expression matched against the client's ISP name.
+	ISP    string             `yaml:"isp"`
+	Policy exporter.ISPPolicy `yaml:"policy"`
+	// Interval is, for the interval policy, the minimum time between runs.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Default returns the default configuration.
+func Default() *Config {
+	return &Config{
+		Web: WebConfig{
+			ListenAddress: ":8080",
+		},
+		GracefulShutdown: GracefulShutdown{
+			Enabled: true,
+			Timeout: 10 * time.Second,
+		},
+		Test: TestConfig{
+			Mode:      exporter.TestModeInterval,
+			Interval:  1 * time.Hour,
+			Blackouts: []scheduler.Window{},
+			Timeout:   1 * time.Minute,
+			MinAge:    5 * time.Minute,
+			PingMode:  exporter.PingModeHTTP,
+			PingCount: 10,
+			Phases:    exporter.TestPhases{exporter.PhasePing, exporter.PhaseDownload, exporter.PhaseUpload},
+		},
+		Servers: ServersConfig{
+			IDs:    []int{},
+			Count:  1,
+			Labels: []string{},
+		},
+		MetricSchema: metric_schema.V1,
+		History: HistoryConfig{
+			MaxCount: 1000,
+		},
+		BandwidthBudget: BandwidthBudgetConfig{
+			Period:          bandwidth_budget.PeriodMonthly,
+			SavingThreshold: 0.2,
+		},
+		ISPPolicies: []ISPPolicyConfig{},
+	}
+}
+
+// Load reads the YAML config file at path. Options missing from the file are
+// left at their defaults.
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+	cfg := Default()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the configuration is usable.
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Web.ListenAddress == "" {
+		errs = append(errs, errors.New("web.listen-address must not be empty"))
+	}
+	if _, err := exporter.ParseTestMode(string(c.Test.Mode)); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := metric_schema.Parse(string(c.MetricSchema)); err != nil {
+		errs = append(errs, err)
+	}
+	if err := web.Validate(c.Web.ConfigFile); err != nil {
+		errs = append(errs, fmt.Errorf("invalid web config file %s: %w", c.Web.ConfigFile, err))
+	}
+	if c.Test.Interval <= 0 {
+		errs = append(errs, errors.New("test-interval must be positive"))
+	}
+	if _, err := c.Scheduler(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Test.Timeout <= 0 {
+		errs = append(errs, errors.New("test-timeout must be positive"))
+	}
+	if c.Test.MinAge < 0 {
+		errs = append(errs, errors.New("test-min-age must not be negative"))
+	}
+	if c.Test.PacketLossDuration < 0 {
+		errs = append(errs, errors.New("packet-loss-duration must not be negative"))
+	}
+	if _, err := exporter.ParsePingMode(string(c.Test.PingMode)); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Test.PingCount < 1 {
+		errs = append(errs, errors.New("ping-count must be at least 1"))
+	}
+	if len(c.Test.Phases) == 0 {
+		errs = append(errs, errors.New("test-phases must select at least one phase"))
+	} else if err := c.Test.Phases.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.GracefulShutdown.Timeout < 0 {
+		errs = append(errs, errors.New("graceful-shutdown-timeout must not be negative"))
+	}
+	if c.Servers.Count < 1 {
+		errs = append(errs, errors.New("server-count must be at least 1"))
+	}
+	for i, id := range c.Servers.IDs {
+		if id <= 0 {
+			errs = append(errs, fmt.Errorf("invalid server id %d", id))
+		} else if slices.Contains(c.Servers.IDs[:i], id) {
+			errs = append(errs, fmt.Errorf("duplicate server id %d", id))
+		}
+	}
+	if len(c.Servers.Labels) > 0 {
+		if err := exporter.ValidateServerLabels(c.Servers.Labels); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.ResultMaxAge < 0 {
+		errs = append(errs, errors.New("result-max-age must not be negative"))
+	}
+	if c.History.MaxAge < 0 {
+		errs = append(errs, errors.New("history-max-age must not be negative"))
+	}
+	if c.History.MaxCount < 0 {
+		errs = append(errs, errors.New("history-max-count must not be negative"))
+	}
+	if _, err := bandwidth_budget.ParsePeriod(string(c.BandwidthBudget.Period)); err != nil {
+		errs = append(errs, err)
+	}
+	if c.BandwidthBudget.SavingThreshold < 0 || c.BandwidthBudget.SavingThreshold > 1 {
+		errs = append(errs, errors.New("bandwidth-budget-saving-threshold must be between 0 and 1"))
+	}
+	if _, err := c.ISPRules(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// RegisterFlags defines a flag for each option on fs, which sets the option
+// in c. The flags' defaults are the options' current values.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&c.Debug, "debug", c.Debug, "sets log level to debug")
+	fs.StringVar(&c.Web.ListenAddress, "web.listen-address", c.Web.ListenAddress, "address to listen on for HTTP requests")
+	fs.StringVar(&c.Web.ConfigFile, "web.config.file", c.Web.ConfigFile, "path to a web config file in the Prometheus exporter-toolkit format, which can enable TLS and basic auth")
+	fs.BoolVar(&c.Web.EnableLifecycle, "web.enable-lifecycle", c.Web.EnableLifecycle, "enable reloading the config file via HTTP POST requests to /-/reload")
+	fs.BoolVar(&c.GracefulShutdown.Enabled, "graceful-shutdown", c.GracefulShutdown.Enabled, "allow in flight speed tests to finish before shutting down")
+	fs.DurationVar(&c.GracefulShutdown.Timeout, "graceful-shutdown-timeout", c.GracefulShutdown.Timeout, "graceful shutdown timeout")
+	fs.DurationVar(&c.Test.Timeout, "test-timeout", c.Test.Timeout, "timeout for speedtest runs")
+	fs.DurationVar(&c.Test.Interval, "test-interval", c.Test.Interval, "interval between speedtest runs")
+	fs.StringVar(&c.Test.Schedule, "test-schedule", c.Test.Schedule, "cron expression on which to run speedtests, e.g. \"0 */2 * * *\", overriding test-interval")
+	fs.DurationVar(&c.Test.Splay, "test-splay", c.Test.Splay, "maximum random delay added to each scheduled speedtest run, to spread out runs from many exporters")
+	fs.Var(windowsValue{&c.Test.Blackouts}, "test-blackouts", "comma separated list of daily windows of local time in which no speedtests are scheduled, e.g. 18:00-23:00")
+	fs.BoolVar(&c.Collectors.Go, "gocollector", c.Collectors.Go, "enables go stats exporter")
+	fs.BoolVar(&c.Collectors.Process, "processcollector", c.Collectors.Process, "enables process stats exporter")
+	fs.BoolVar(&c.Test.SavingMode, "saving-mode", c.Test.SavingMode, "enables saving mode in speedtest-go to reduce bandwidth usage at the cost of accuracy")
+	fs.Var(serverIDsValue{&c.Servers.IDs}, "server-ids", "comma separated list of speedtest server IDs to test against, falls back to the closest server if a pinned server isn't available")
+	fs.Var(serverLabelsValue{&c.Servers.Labels}, "server-labels", "comma separated list of labels identifying servers on per-server metrics, from server_id, url, name, country, sponsor, lat, lon and distance, or \"all\", defaults to all of them in the v1 metric schema and server_id in v2")
+	fs.IntVar(&c.Servers.Count, "server-count", c.Servers.Count, "number of closest speedtest servers to test against when no servers are pinned")
+	fs.DurationVar(&c.ResultMaxAge, "result-max-age", c.ResultMaxAge, "how long to keep exporting the last successful result when subsequent runs fail, 0 keeps it indefinitely")
+	fs.StringVar((*string)(&c.Test.Mode), "test-mode", string(c.Test.Mode), "what triggers speedtest runs: \"interval\" runs every test-interval, \"scrape\" runs when scraped and the last run is older than test-min-age")
+	fs.DurationVar(&c.Test.MinAge, "test-min-age", c.Test.MinAge, "in scrape mode, minimum age of the last run before a scrape triggers a new one")
+	fs.DurationVar(&c.Test.PacketLossDuration, "packet-loss-duration", c.Test.PacketLossDuration, "how long to sample packet loss for during each test, 0 disables packet loss analysis")
+	fs.StringVar((*string)(&c.Test.PingMode), "ping-mode", string(c.Test.PingMode), "how to measure latency to speedtest servers: \"http\" or \"tcp\" via the server, or \"icmp\" echo requests, which need unprivileged ICMP sockets to be permitted")
+	fs.Var(testPhasesValue{&c.Test.Phases}, "test-phases", "comma separated list of the phases of each speedtest to run, from ping, download and upload")
+	fs.IntVar(&c.Test.PingCount, "ping-count", c.Test.PingCount, "number of pings sent to each speedtest server to measure latency")
+	fs.StringVar((*string)(&c.MetricSchema), "metric-schema", string(c.MetricSchema), "metric names and units to export: \"v1\" for the original metrics, \"v2\" for metrics following Prometheus naming conventions")
+	fs.StringVar(&c.History.File, "history-file", c.History.File, "file to persist the history of speedtest runs to, history is only kept in memory if unset")
+	fs.DurationVar(&c.History.MaxAge, "history-max-age", c.History.MaxAge, "how long to keep speedtest runs in the history, 0 keeps them indefinitely")
+	fs.IntVar(&c.History.MaxCount, "history-max-count", c.History.MaxCount, "maximum number of speedtest runs to keep in the history, 0 is unlimited")
+	fs.StringVar(&c.API.Token, "api-token", c.API.Token, "bearer token required to trigger speedtest runs via /api/v1/run, which is disabled if unset")
+	fs.Var(&c.BandwidthBudget.Limit, "bandwidth-budget", "bytes speedtests may transfer per budget period, e.g. 50GB or 20GiB, 0 disables the budget")
+	fs.StringVar((*string)(&c.BandwidthBudget.Period), "bandwidth-budget-period", string(c.BandwidthBudget.Period), "how often the bandwidth budget resets: \"daily\" or \"monthly\"")
+	fs.Float64Var(&c.BandwidthBudget.SavingThreshold, "bandwidth-budget-saving-threshold", c.BandwidthBudget.SavingThreshold, "fraction of the bandwidth budget remaining below which speedtests run in saving mode")
+	fs.StringVar(&c.BandwidthBudget.File, "bandwidth-budget-file", c.BandwidthBudget.File, "file to persist bandwidth budget usage to, usage is only kept in memory if unset")
+	fs.BoolVar(&c.ClientInfo.IP, "client-info-ip", c.ClientInfo.IP, "adds the client's public IP address, as seen by speedtest.net, to speedtest_client_info")
+}
+
+// EnvPrefix is the prefix of the environment variables which set options.
+const EnvPrefix = "SPEEDTEST_EXPORTER_"
+
+// EnvVar returns the environment variable which sets the flag with the given
+// name, e.g. SPEEDTEST_EXPORTER_TEST_INTERVAL for test-interval.
+func EnvVar(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// Parse builds the configuration from the command line args. Defaults are
+// overridden by the config file named by the config.file flag, if any, then by
+// the environment variables named by EnvVar, then by flags explicitly set in
+// args. Parse can be called again with the same args to reload the config
+// file.
+func Parse(name string, args []string) (*Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config.file", "", "path to a YAML config file, options set by flags take precedence over the file")
+	Default().RegisterFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", name)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nEvery flag can also be set by an environment variable named after it, e.g. %s for -test-interval.\n", EnvVar("test-interval"))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	path := *file
+	if env, ok := os.LookupEnv(EnvVar("config.file")); ok && !set["config.file"] {
+		path = env
+	}
+	cfg := Default()
+	if path != "" {
+		var err error
+		cfg, err = Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bound := flag.NewFlagSet(name, flag.ContinueOnError)
+	cfg.RegisterFlags(bound)
+	var err error
+	bound.VisitAll(func(f *flag.Flag) {
+		env := EnvVar(f.Name)
+		value, ok := os.LookupEnv(env)
+		if !ok || set[f.Name] || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, env, setErr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "config.file" || err != nil {
+			return
+		}
+		err = bound.Set(f.Name, f.Value.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// redacted replaces the values of secret options when logging them.
+const redacted = "<redacted>"
+
+// secretFlags are the flags whose values mustn't be logged.
+var secretFlags = map[string]bool{
+	"api-token": true,
+}
+
+// Values returns the value of each option, keyed by flag name, for logging.
+// Secrets are redacted.
+func (c *Config) Values() map[string]string {
+	// Register the flags on a copy, so c isn't aliased by the flag set.
+	copied := *c
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	copied.RegisterFlags(fs)
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" {
+			value = redacted
+		}
+		values[f.Name] = value
+	})
+	return values
+}
+
+// StaticChanges returns the flags for the options which differ between c and
+// other, but only take effect on restart.
+func (c *Config) StaticChanges(other *Config) []string {
+	changed := []string{}
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("web.listen-address", c.Web.ListenAddress != other.Web.ListenAddress)
+	check("web.config.file", c.Web.ConfigFile != other.Web.ConfigFile)
+	check("web.enable-lifecycle", c.Web.EnableLifecycle != other.Web.EnableLifecycle)
+	check("test-mode", c.Test.Mode != other.Test.Mode)
+	check("metric-schema", c.MetricSchema != other.MetricSchema)
+	check("gocollector", c.Collectors.Go != other.Collectors.Go)
+	check("processcollector", c.Collectors.Process != other.Collectors.Process)
+	check("history-file", c.History.File != other.History.File)
+	check("history-max-age", c.History.MaxAge != other.History.MaxAge)
+	check("history-max-count", c.History.MaxCount != other.History.MaxCount)
+	check("api-token", c.API.Token != other.API.Token)
+	check("bandwidth-budget", c.BandwidthBudget.Limit != other.BandwidthBudget.Limit)
+	check("bandwidth-budget-period", c.BandwidthBudget.Period != other.BandwidthBudget.Period)
+	check("bandwidth-budget-saving-threshold", c.BandwidthBudget.SavingThreshold != other.BandwidthBudget.SavingThreshold)
+	check("bandwidth-budget-file", c.BandwidthBudget.File != other.BandwidthBudget.File)
+	check("server-labels", !slices.Equal(c.Servers.Labels, other.Servers.Labels))
+	check("client-info-ip", c.ClientInfo.IP != other.ClientInfo.IP)
+	return changed
+}
+
+// ISPRules returns the exporter's rules for the configured ISP policies.
+func (c *Config) ISPRules() ([]exporter.ISPRule, error) {
+	rules := make([]exporter.ISPRule, 0, len(c.ISPPolicies))
+	for i, p := range c.ISPPolicies {
+		if p.ISP == "" {
+			return nil, fmt.Errorf("isp policy %d: isp must not be empty", i)
+		}
+		re, err := regexp.Compile(p.ISP)
+		if err != nil {
+			return nil, fmt.Errorf("isp policy %d: invalid isp pattern: %w", i, err)
+		}
+		if _, err := exporter.ParseISPPolicy(string(p.Policy)); err != nil {
+			return nil, fmt.Errorf("isp policy %d: %w", i, err)
+		}
+		if p.Policy == exporter.ISPPolicyInterval && p.Interval <= 0 {
+			return nil, fmt.Errorf("isp policy %d: interval must be positive", i)
+		}
+		rules = append(rules, exporter.ISPRule{ISP: re, Policy: p.Policy, Interval: p.Interval})
+	}
+	return rules, nil
+}
+
+// Scheduler returns the scheduler for speedtest runs.
+func (c *Config) Scheduler() (*scheduler.Scheduler, error) {
+	return scheduler.New(scheduler.Opts{
+		Interval:  c.Test.Interval,
+		Cron:      c.Test.Schedule,
+		Splay:     c.Test.Splay,
+		Blackouts: c.Test.Blackouts,
+	})
+}
+
+// windowsValue is a flag.Value for a comma separated list of windows.
+type windowsValue struct {
+	windows *[]scheduler.Window
+}
+
+func (v windowsValue) String() string {
+	if v.windows == nil {
+		return ""
+	}
+	windows := make([]string, 0, len(*v.windows))
+	for _, w := range *v.windows {
+		windows = append(windows, w.String())
+	}
+	return strings.Join(windows, ",")
+}
+
+func (v windowsValue) Set(s string) error {
+	windows := []scheduler.Window{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		w, err := scheduler.ParseWindow(field)
+		if err != nil {
+			return err
+		}
+		windows = append(windows, w)
+	}
+	*v.windows = windows
+	return nil
+}
+
+// serverIDsValue is a flag.Value for a comma separated list of server IDs.
+type serverIDsValue struct {
+	ids *[]int
+}
+
+func (v serverIDsValue) String() string {
+	if v.ids == nil {
+		return ""
+	}
+	ids := make([]string, 0, len(*v.ids))
+	for _, id := range *v.ids {
+		ids = append(ids, strconv.Itoa(id))
+	}
+	return strings.Join(ids, ",")
+}
+
+func (v serverIDsValue) Set(s string) error {
+	ids, err := exporter.ParseServerIDs(s)
+	if err != nil {
+		return err
+	}
+	*v.ids = ids
+	return nil
+}
+
+// serverLabelsValue is a flag.Value for a comma separated list of server
+// labels.
+type serverLabelsValue struct {
+	labels *[]string
+}
+
+func (v serverLabelsValue) String() string {
+	if v.labels == nil {
+		return ""
+	}
+	return strings.Join(*v.labels, ",")
+}
+
+func (v serverLabelsValue) Set(s string) error {
+	labels, err := exporter.ParseServerLabels(s)
+	if err != nil {
+		return err
+	}
+	*v.labels = labels
+	return nil
+}
+
+// testPhasesValue is a flag.Value for a comma separated list of test phases.
+type testPhasesValue struct {
+	phases *exporter.TestPhases
+}
+
+func (v testPhasesValue) String() string {
+	if v.phases == nil {
+		return ""
+	}
+	return strings.Join(*v.phases, ",")
+}
+
+func (v testPhasesValue) Set(s string) error {
+	phases, err := exporter.ParseTestPhases(s)
+	if err != nil {
+		return err
+	}
+	*v.phases = phases
+	return nil
+}
@@ -0,0 +1,342 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"speedtest-exporter/internal/bandwidth_budget"
+	"speedtest-exporter/internal/exporter"
+	"speedtest-exporter/internal/metric_schema"
+	"speedtest-exporter/internal/scheduler"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+const testConfig = `
+web:
+  listen_address: ":9516"
+test:
+  mode: scrape
+  interval: 30m
+  saving_mode: true
+  ping_mode: tcp
+  schedule: "0 */2 * * *"
+  blackouts: ["18:00-23:00"]
+servers:
+  ids: [1234, 5678]
+  labels: [server_id, name]
+metric_schema: v2
+history:
+  max_count: 10
+bandwidth_budget:
+  limit: 50GB
+  period: daily
+isp_policies:
+  - isp: "(?i)lte"
+    policy: interval
+    interval: 6h
+`
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	cfg, err := Load(writeConfig(t, testConfig))
+	require.NoError(err)
+	assert.Equal(":9516", cfg.Web.ListenAddress)
+	assert.Equal(exporter.TestModeScrape, cfg.Test.Mode)
+	assert.Equal(30*time.Minute, cfg.Test.Interval)
+	assert.True(cfg.Test.SavingMode)
+	assert.Equal(exporter.PingModeTCP, cfg.Test.PingMode)
+	assert.Equal([]int{1234, 5678}, cfg.Servers.IDs)
+	assert.Equal([]string{"server_id", "name"}, cfg.Servers.Labels)
+	assert.Equal(metric_schema.V2, cfg.MetricSchema)
+	assert.Equal(10, cfg.History.MaxCount)
+	assert.Equal(bandwidth_budget.Bytes(50e9), cfg.BandwidthBudget.Limit)
+	assert.Equal(bandwidth_budget.PeriodDaily, cfg.BandwidthBudget.Period)
+	assert.Equal(0.2, cfg.BandwidthBudget.SavingThreshold)
+	assert.Equal("0 */2 * * *", cfg.Test.Schedule)
+	assert.Equal([]scheduler.Window{{Start: 18 * time.Hour, End: 23 * time.Hour}}, cfg.Test.Blackouts)
+	rules, err := cfg.ISPRules()
+	require.NoError(err)
+	require.Len(rules, 1)
+	assert.True(rules[0].ISP.MatchString("Example LTE"))
+	assert.Equal(exporter.ISPPolicyInterval, rules[0].Policy)
+	assert.Equal(6*time.Hour, rules[0].Interval)
+	// options missing from the file keep their defaults
+	assert.Equal(time.Minute, cfg.Test.Timeout)
+	assert.Equal(1, cfg.Servers.Count)
+	assert.True(cfg.GracefulShutdown.Enabled)
+
+	cfg, err = Load(writeConfig(t, ""))
+	require.NoError(err)
+	assert.Equal(Default(), cfg)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		desc    string
+		content string
+	}{
+		{"unknown_key", "test:\n  intervals: 1h\n"},
+		{"bad_duration", "test:\n  interval: soon\n"},
+		{"bad_test_mode", "test:\n  mode: sometimes\n"},
+		{"bad_ping_mode", "test:\n  ping_mode: udp\n"},
+		{"server_labels_without_id", "servers:\n  labels: [name]\n"},
+		{"bad_isp_policy", "isp_policies:\n  - isp: LTE\n    policy: off\n"},
+		{"bad_isp_pattern", "isp_policies:\n  - isp: \"(\"\n    policy: saving\n"},
+		{"empty_isp_pattern", "isp_policies:\n  - policy: saving\n"},
+		{"isp_policy_without_interval", "isp_policies:\n  - isp: LTE\n    policy: interval\n"},
+		{"bad_metric_schema", "metric_schema: v3\n"},
+		{"zero_interval", "test:\n  interval: 0s\n"},
+		{"zero_server_count", "servers:\n  count: 0\n"},
+		{"negative_server_id", "servers:\n  ids: [-1]\n"},
+		{"duplicate_server_id", "servers:\n  ids: [1, 1]\n"},
+		{"empty_listen_address", "web:\n  listen_address: \"\"\n"},
+		{"invalid_web_config_file", "web:\n  config_file: config.yml\n"},
+		{"bad_schedule", "test:\n  schedule: every tuesday\n"},
+		{"bad_blackout", "test:\n  blackouts: [\"18:00\"]\n"},
+		{"negative_splay", "test:\n  splay: -1m\n"},
+		{"bad_budget_limit", "bandwidth_budget:\n  limit: lots\n"},
+		{"bad_budget_period", "bandwidth_budget:\n  period: weekly\n"},
+		{"bad_saving_threshold", "bandwidth_budget:\n  saving_threshold: 1.5\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.content))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := Load(filepath.Join(t.TempDir(), "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	path := writeConfig(t, testConfig)
+	tests := []struct {
+		desc  string
+		args  []string
+		env   map[string]string
+		check func(*assert.Assertions, *Config)
+	}{
+		{
+			"defaults",
+			[]string{},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal(Default(), cfg)
+			},
+		},
+		{
+			"flags",
+			[]string{"-test-interval=5m", "-server-ids=1,2", "-web.listen-address=:1234", "-web.enable-lifecycle", "-bandwidth-budget=20GiB"},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.True(cfg.Web.EnableLifecycle)
+				assert.Equal(5*time.Minute, cfg.Test.Interval)
+				assert.Equal(bandwidth_budget.Bytes(20<<30), cfg.BandwidthBudget.Limit)
+				assert.Equal([]int{1, 2}, cfg.Servers.IDs)
+				assert.Equal(":1234", cfg.Web.ListenAddress)
+			},
+		},
+		{
+			"schedule_flags",
+			[]string{"-test-schedule=@hourly", "-test-splay=5m", "-test-blackouts=18:00-23:00,01:00-02:00"},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal("@hourly", cfg.Test.Schedule)
+				assert.Equal(5*time.Minute, cfg.Test.Splay)
+				assert.Len(cfg.Test.Blackouts, 2)
+				assert.Equal("01:00-02:00", cfg.Test.Blackouts[1].String())
+			},
+		},
+		{
+			"ping_flags",
+			[]string{"-ping-mode=tcp", "-ping-count=20"},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal(exporter.PingModeTCP, cfg.Test.PingMode)
+				assert.Equal(20, cfg.Test.PingCount)
+			},
+		},
+		{
+			"test_phases",
+			[]string{"-test-phases=download,upload"},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal(exporter.TestPhases{exporter.PhaseDownload, exporter.PhaseUpload}, cfg.Test.Phases)
+			},
+		},
+		{
+			"server_labels",
+			[]string{"-server-labels=server_id, country"},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal([]string{"server_id", "country"}, cfg.Servers.Labels)
+			},
+		},
+		{
+			"client_info_ip",
+			[]string{"-client-info-ip"},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.True(cfg.ClientInfo.IP)
+			},
+		},
+		{
+			"config_file",
+			[]string{"-config.file", path},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal(30*time.Minute, cfg.Test.Interval)
+				assert.Equal([]int{1234, 5678}, cfg.Servers.IDs)
+			},
+		},
+		{
+			"flags_override_config_file",
+			[]string{"-test-interval=5m", "-config.file", path, "-saving-mode=false"},
+			nil,
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal(5*time.Minute, cfg.Test.Interval)
+				assert.False(cfg.Test.SavingMode)
+				assert.Equal(":9516", cfg.Web.ListenAddress)
+			},
+		},
+		{
+			"env_overrides_config_file",
+			[]string{"-config.file", path},
+			map[string]string{"SPEEDTEST_EXPORTER_SERVER_IDS": "42"},
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal([]int{42}, cfg.Servers.IDs)
+			},
+		},
+		{
+			"env",
+			[]string{},
+			map[string]string{
+				"SPEEDTEST_EXPORTER_TEST_INTERVAL":      "10m",
+				"SPEEDTEST_EXPORTER_SAVING_MODE":        "true",
+				"SPEEDTEST_EXPORTER_WEB_LISTEN_ADDRESS": ":9000",
+				"SPEEDTEST_EXPORTER_GOCOLLECTOR":        "1",
+			},
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal(10*time.Minute, cfg.Test.Interval)
+				assert.True(cfg.Test.SavingMode)
+				assert.Equal(":9000", cfg.Web.ListenAddress)
+				assert.True(cfg.Collectors.Go)
+			},
+		},
+		{
+			"config_file_from_env",
+			[]string{},
+			map[string]string{"SPEEDTEST_EXPORTER_CONFIG_FILE": path},
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal(30*time.Minute, cfg.Test.Interval)
+			},
+		},
+		{
+			"flags_override_env",
+			[]string{"-server-ids=7"},
+			map[string]string{"SPEEDTEST_EXPORTER_SERVER_IDS": "42"},
+			func(assert *assert.Assertions, cfg *Config) {
+				assert.Equal([]int{7}, cfg.Servers.IDs)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Parse("test", tt.args)
+			require.NoError(t, err)
+			tt.check(assert.New(t), cfg)
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		desc string
+		args []string
+	}{
+		{"unknown_flag", []string{"-nope"}},
+		{"bad_server_ids", []string{"-server-ids=abc"}},
+		{"duplicate_server_ids", []string{"-server-ids=1,2,1"}},
+		{"bad_test_mode", []string{"-test-mode=sometimes"}},
+		{"bad_ping_mode", []string{"-ping-mode=udp"}},
+		{"zero_ping_count", []string{"-ping-count=0"}},
+		{"unknown_test_phase", []string{"-test-phases=ping,jitter"}},
+		{"empty_test_phases", []string{"-test-phases="}},
+		{"unknown_server_label", []string{"-server-labels=server_id,host"}},
+		{"bad_schedule", []string{"-test-schedule=* *"}},
+		{"bad_blackouts", []string{"-test-blackouts=18:00-25:00"}},
+		{"missing_config_file", []string{"-config.file", "/nonexistent/config.yml"}},
+		{"missing_web_config_file", []string{"-web.config.file", "/nonexistent/web.yml"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := Parse("test", tt.args)
+			assert.Error(t, err)
+		})
+	}
+
+	envTests := []struct {
+		desc  string
+		env   string
+		value string
+	}{
+		{"bad_duration", "SPEEDTEST_EXPORTER_TEST_INTERVAL", "soon"},
+		{"bad_bool", "SPEEDTEST_EXPORTER_SAVING_MODE", "maybe"},
+		{"invalid_value", "SPEEDTEST_EXPORTER_SERVER_COUNT", "0"},
+		{"duplicate_server_ids", "SPEEDTEST_EXPORTER_SERVER_IDS", "42,42"},
+	}
+	for _, tt := range envTests {
+		t.Run(tt.desc, func(t *testing.T) {
+			t.Setenv(tt.env, tt.value)
+			_, err := Parse("test", nil)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStaticChanges(t *testing.T) {
+	a := Default()
+	b := Default()
+	b.Test.Interval = time.Minute
+	b.Servers.IDs = []int{1}
+	assert.Empty(t, a.StaticChanges(b))
+
+	b.Web.ListenAddress = ":1234"
+	b.MetricSchema = metric_schema.V2
+	assert.Equal(t, []string{"web.listen-address", "metric-schema"}, a.StaticChanges(b))
+}
+
+func TestEnvVar(t *testing.T) {
+	assert.Equal(t, "SPEEDTEST_EXPORTER_TEST_INTERVAL", EnvVar("test-interval"))
+	assert.Equal(t, "SPEEDTEST_EXPORTER_WEB_LISTEN_ADDRESS", EnvVar("web.listen-address"))
+	assert.Equal(t, "SPEEDTEST_EXPORTER_GOCOLLECTOR", EnvVar("gocollector"))
+}
+
+func TestValues(t *testing.T) {
+	assert := assert.New(t)
+	cfg := Default()
+	cfg.Servers.IDs = []int{1, 2}
+	values := cfg.Values()
+	assert.Equal("1h0m0s", values["test-interval"])
+	assert.Equal("1,2", values["server-ids"])
+	assert.Equal("", values["api-token"])
+
+	cfg.API.Token = "secret"
+	assert.Equal(redacted, cfg.Values()["api-token"])
+}
@@ -0,0 +1,145 @@
+package connection_tracer
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ConnectionTracer is an http.RoundTripper which times the DNS lookups, TCP
+// connects and TLS handshakes of the connections its requests make, and the
+// time to the first byte of their responses, by target host. Requests which
+// reuse a connection only observe the time to first byte.
+type ConnectionTracer struct {
+	T               http.RoundTripper
+	dnsLookup       *prometheus.HistogramVec
+	connect         *prometheus.HistogramVec
+	tlsHandshake    *prometheus.HistogramVec
+	timeToFirstByte *prometheus.HistogramVec
+}
+
+type Opts struct {
+	// Transport is the RoundTripper whose requests are traced. Defaults to
+	// http.DefaultTransport.
+	Transport http.RoundTripper
+}
+
+func New(opts Opts) *ConnectionTracer {
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport
+	}
+	// from 1ms to ~4s
+	buckets := prometheus.ExponentialBuckets(0.001, 2, 13)
+	return &ConnectionTracer{
+		T: opts.Transport,
+		dnsLookup: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "speedtest_http_dns_lookup_duration_seconds",
+			Help:    "Duration of DNS lookups for speedtest requests in seconds",
+			Buckets: buckets,
+		}, []string{"host"}),
+		connect: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "speedtest_http_connect_duration_seconds",
+			Help:    "Duration of TCP connects for speedtest requests in seconds",
+			Buckets: buckets,
+		}, []string{"host"}),
+		tlsHandshake: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "speedtest_http_tls_handshake_duration_seconds",
+			Help:    "Duration of TLS handshakes for speedtest requests in seconds",
+			Buckets: buckets,
+		}, []string{"host"}),
+		timeToFirstByte: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "speedtest_http_time_to_first_byte_seconds",
+			Help:    "Time from writing speedtest requests to the first byte of their responses in seconds",
+			Buckets: buckets,
+		}, []string{"host"}),
+	}
+}
+
+// requestTrace holds the start times of a single request's trace events.
+// Connects may be attempted to several addresses concurrently, so connect
+// starts are keyed by address.
+type requestTrace struct {
+	mut          sync.Mutex
+	dnsStart     time.Time
+	connectStart map[string]time.Time
+	tlsStart     time.Time
+	wroteRequest time.Time
+}
+
+func (c *ConnectionTracer) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	rt := &requestTrace{
+		connectStart: map[string]time.Time{},
+		wroteRequest: time.Now(),
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			rt.dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			if info.Err == nil && !rt.dnsStart.IsZero() {
+				c.dnsLookup.WithLabelValues(host).Observe(time.Since(rt.dnsStart).Seconds())
+			}
+		},
+		ConnectStart: func(_, addr string) {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			rt.connectStart[addr] = time.Now()
+		},
+		ConnectDone: func(_, addr string, err error) {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			if start, ok := rt.connectStart[addr]; ok && err == nil {
+				c.connect.WithLabelValues(host).Observe(time.Since(start).Seconds())
+			}
+		},
+		TLSHandshakeStart: func() {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			rt.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			if err == nil && !rt.tlsStart.IsZero() {
+				c.tlsHandshake.WithLabelValues(host).Observe(time.Since(rt.tlsStart).Seconds())
+			}
+		},
+		// Measuring from when the request was written, rather than when it
+		// started, keeps the time taken to send upload bodies out of the time
+		// to first byte.
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			rt.wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			rt.mut.Lock()
+			defer rt.mut.Unlock()
+			c.timeToFirstByte.WithLabelValues(host).Observe(time.Since(rt.wroteRequest).Seconds())
+		},
+	}
+	return c.T.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
+
+func (c *ConnectionTracer) Describe(ch chan<- *prometheus.Desc) {
+	c.dnsLookup.Describe(ch)
+	c.connect.Describe(ch)
+	c.tlsHandshake.Describe(ch)
+	c.timeToFirstByte.Describe(ch)
+}
+
+func (c *ConnectionTracer) Collect(ch chan<- prometheus.Metric) {
+	c.dnsLookup.Collect(ch)
+	c.connect.Collect(ch)
+	c.tlsHandshake.Collect(ch)
+	c.timeToFirstByte.Collect(ch)
+}
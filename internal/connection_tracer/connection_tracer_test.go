@@ -0,0 +1,97 @@
+package connection_tracer
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+// sampleCount returns the number of observations of the histogram for host.
+func sampleCount(t *testing.T, h *prometheus.HistogramVec, host string) uint64 {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(h)
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "host" && label.GetValue() == host {
+					return metric.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func get(t *testing.T, client *http.Client, url string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+func TestRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "OK")
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	require.NoError(t, err)
+	// a hostname, rather than the listener's IP address, needs a DNS lookup
+	host := net.JoinHostPort("localhost", port)
+
+	c := New(Opts{Transport: &http.Transport{}})
+	client := &http.Client{Transport: c}
+	get(t, client, "http://"+host)
+	assert.Equal(uint64(1), sampleCount(t, c.dnsLookup, host))
+	assert.Equal(uint64(1), sampleCount(t, c.connect, host))
+	assert.Equal(uint64(0), sampleCount(t, c.tlsHandshake, host))
+	assert.Equal(uint64(1), sampleCount(t, c.timeToFirstByte, host))
+
+	// the second request reuses the connection
+	get(t, client, "http://"+host)
+	assert.Equal(uint64(1), sampleCount(t, c.dnsLookup, host))
+	assert.Equal(uint64(1), sampleCount(t, c.connect, host))
+	assert.Equal(uint64(2), sampleCount(t, c.timeToFirstByte, host))
+}
+
+func TestRoundTripTLS(t *testing.T) {
+	assert := assert.New(t)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "OK")
+	}))
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	c := New(Opts{Transport: srv.Client().Transport})
+	get(t, &http.Client{Transport: c}, srv.URL)
+	assert.Equal(uint64(0), sampleCount(t, c.dnsLookup, host))
+	assert.Equal(uint64(1), sampleCount(t, c.connect, host))
+	assert.Equal(uint64(1), sampleCount(t, c.tlsHandshake, host))
+	assert.Equal(uint64(1), sampleCount(t, c.timeToFirstByte, host))
+	// no DNS lookup series, as the URL has an IP address
+	assert.Equal(3, testutil.CollectAndCount(c))
+}
+
+func TestRoundTripFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	host := srv.Listener.Addr().String()
+	srv.Close()
+
+	c := New(Opts{Transport: &http.Transport{}})
+	_, err := (&http.Client{Transport: c}).Get("http://" + host)
+	assert.Error(t, err)
+	assert.Equal(t, uint64(0), sampleCount(t, c.connect, host))
+	assert.Equal(t, uint64(0), sampleCount(t, c.timeToFirstByte, host))
+}
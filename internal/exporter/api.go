@@ -0,0 +1,297 @@
+package exporter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// apiServer is the JSON representation of a speedtest server.
+type apiServer struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Sponsor    string  `json:"sponsor"`
+	Country    string  `json:"country"`
+	Host       string  `json:"host"`
+	URL        string  `json:"url"`
+	Lat        string  `json:"lat"`
+	Lon        string  `json:"lon"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// apiResult is the JSON representation of a Result. Unlike Result, which is
+// serialized as speedtest-go represents it, durations are in seconds and
+// speeds in bits per second.
+type apiResult struct {
+	Server    apiServer `json:"server"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	PingMode  PingMode  `json:"ping_mode"`
+	// The latencies and speeds are omitted if their phase wasn't run.
+	LatencySeconds        *float64 `json:"latency_seconds,omitempty"`
+	JitterSeconds         *float64 `json:"jitter_seconds,omitempty"`
+	LatencyMinSeconds     *float64 `json:"latency_min_seconds,omitempty"`
+	LatencyMaxSeconds     *float64 `json:"latency_max_seconds,omitempty"`
+	DownloadBitsPerSecond *float64 `json:"download_bits_per_second,omitempty"`
+	UploadBitsPerSecond   *float64 `json:"upload_bits_per_second,omitempty"`
+	// PacketLossRatio is omitted if packet loss wasn't measured.
+	PacketLossRatio *float64 `json:"packet_loss_ratio,omitempty"`
+	BytesDownloaded int64    `json:"bytes_downloaded"`
+	BytesUploaded   int64    `json:"bytes_uploaded"`
+	// Phases is omitted if every phase was run.
+	Phases TestPhases `json:"phases,omitempty"`
+}
+
+// apiLatest is the response of the latest results endpoint.
+type apiLatest struct {
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// Error is set if the last run failed before any server could be tested.
+	Error string `json:"error,omitempty"`
+	// Results are the last successful results for each server, as exported
+	// on /metrics.
+	Results []apiResult `json:"results"`
+	// Attempts are the outcomes of the last run against each server.
+	Attempts []apiResult `json:"attempts"`
+}
+
+// apiRun is the JSON representation of a Run.
+type apiRun struct {
+	ID       string      `json:"id"`
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	Error    string      `json:"error,omitempty"`
+	Skipped  bool        `json:"skipped,omitempty"`
+	Results  []apiResult `json:"results"`
+}
+
+// Statuses of a speedtest run, as reported by the run endpoint.
+const (
+	RunStatusRunning  = "running"
+	RunStatusFinished = "finished"
+)
+
+// apiRunStatus is the response of the run endpoint.
+type apiRunStatus struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	// Coalesced is set if a run was already in progress when one was
+	// triggered, in which case ID is that of the run in progress.
+	Coalesced bool `json:"coalesced,omitempty"`
+	// Run is set once the run has finished.
+	Run *apiRun `json:"run,omitempty"`
+}
+
+func newAPIRun(run Run) apiRun {
+	return apiRun{
+		ID:       run.ID,
+		Started:  run.Started,
+		Finished: run.Finished,
+		Error:    run.Error,
+		Skipped:  run.Skipped,
+		Results:  newAPIResults(run.Results),
+	}
+}
+
+func newAPIResult(r Result) apiResult {
+	srv := r.Server
+	ret := apiResult{
+		Server: apiServer{
+			ID:         srv.ID,
+			Name:       srv.Name,
+			Sponsor:    srv.Sponsor,
+			Country:    srv.Country,
+			Host:       srv.Host,
+			URL:        srv.URL,
+			Lat:        srv.Lat,
+			Lon:        srv.Lon,
+			DistanceKm: srv.Distance,
+		},
+		Success:         r.Success(),
+		Error:           r.Error,
+		Timestamp:       r.Timestamp,
+		PingMode:        r.pingMode(),
+		Phases:          r.Phases,
+		BytesDownloaded: r.BytesDownloaded,
+		BytesUploaded:   r.BytesUploaded,
+	}
+	// Like the metrics, fields of phases which weren't run are omitted rather
+	// than reported as zero.
+	if r.Phases.Has(PhasePing) {
+		latency, jitter := srv.Latency.Seconds(), srv.Jitter.Seconds()
+		latencyMin, latencyMax := srv.MinLatency.Seconds(), srv.MaxLatency.Seconds()
+		ret.LatencySeconds, ret.JitterSeconds = &latency, &jitter
+		ret.LatencyMinSeconds, ret.LatencyMaxSeconds = &latencyMin, &latencyMax
+	}
+	if r.Phases.Has(PhaseDownload) {
+		download := float64(srv.DLSpeed) * 8
+		ret.DownloadBitsPerSecond = &download
+	}
+	if r.Phases.Has(PhaseUpload) {
+		upload := float64(srv.ULSpeed) * 8
+		ret.UploadBitsPerSecond = &upload
+	}
+	if loss := srv.PacketLoss.Loss(); loss >= 0 {
+		ret.PacketLossRatio = &loss
+	}
+	return ret
+}
+
+func newAPIResults(results []Result) []apiResult {
+	ret := make([]apiResult, 0, len(results))
+	for _, r := range results {
+		ret = append(ret, newAPIResult(r))
+	}
+	return ret
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// LatestResultsHandler returns a handler which responds with the contents of
+// the result cache as JSON.
+func (e *SpeedtestExporter) LatestResultsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, apiLatest{
+			LastAttempt: optionalTime(e.cache.LastAttempt()),
+			LastSuccess: optionalTime(e.cache.LastSuccess()),
+			Error:       e.cache.LastError(),
+			Results:     newAPIResults(e.cache.Get()),
+			Attempts:    newAPIResults(e.cache.Attempts()),
+		})
+	})
+}
+
+// ResultsHandler returns a handler which responds with the retained history of
+// speedtest runs as JSON, newest first. The limit parameter caps the number of
+// runs returned.
+func (e *SpeedtestExporter) ResultsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.store == nil {
+			http.Error(w, "result history isn't retained", http.StatusNotFound)
+			return
+		}
+		limit := 0
+		if param := r.URL.Query().Get("limit"); param != "" {
+			var err error
+			limit, err = strconv.Atoi(param)
+			if err != nil || limit < 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", param), http.StatusBadRequest)
+				return
+			}
+		}
+		records, err := e.store.List(limit)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to list speedtest history")
+			http.Error(w, "failed to list result history", http.StatusInternalServerError)
+			return
+		}
+		runs := make([]apiRun, 0, len(records))
+		for _, record := range records {
+			var run Run
+			if err := json.Unmarshal(record.Data, &run); err != nil {
+				log.Warn().Err(err).Str("run_id", record.ID).Msg("Skipping undecodable speedtest run")
+				continue
+			}
+			runs = append(runs, newAPIRun(run))
+		}
+		writeJSON(w, http.StatusOK, runs)
+	})
+}
+
+// RunHandler returns a handler which starts a speedtest run on POST, and
+// reports the status of the run given by the id parameter on GET. Triggering a
+// run while one is already in progress doesn't start another, but reports the
+// run in progress instead. Requests must present token as a bearer token, or
+// in the X-API-Token header when the Authorization header is taken by basic
+// auth; if token is empty, all requests are rejected.
+func (e *SpeedtestExporter) RunHandler(token string) http.Handler {
+	return requireBearerToken(token, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			id, started := e.TriggerRun()
+			log.Info().Str("run_id", id).Bool("coalesced", !started).Msg("Speedtest run triggered")
+			w.Header().Set("Location", "?id="+id)
+			writeJSON(w, http.StatusAccepted, apiRunStatus{
+				ID:        id,
+				Status:    RunStatusRunning,
+				Coalesced: !started,
+			})
+		case http.MethodGet:
+			e.serveRunStatus(w, r.URL.Query().Get("id"))
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+func (e *SpeedtestExporter) serveRunStatus(w http.ResponseWriter, id string) {
+	if id == "" {
+		http.Error(w, "missing id parameter", http.StatusBadRequest)
+		return
+	}
+	if inFlight, ok := e.runs.InFlight(); ok && inFlight == id {
+		writeJSON(w, http.StatusOK, apiRunStatus{ID: id, Status: RunStatusRunning})
+		return
+	}
+	if e.store != nil {
+		record, ok, err := e.store.Get(id)
+		if err != nil {
+			log.Error().Err(err).Str("run_id", id).Msg("Failed to get speedtest run")
+			http.Error(w, "failed to get run", http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			var run Run
+			if err := json.Unmarshal(record.Data, &run); err != nil {
+				log.Error().Err(err).Str("run_id", id).Msg("Failed to decode speedtest run")
+				http.Error(w, "failed to get run", http.StatusInternalServerError)
+				return
+			}
+			ret := newAPIRun(run)
+			writeJSON(w, http.StatusOK, apiRunStatus{ID: id, Status: RunStatusFinished, Run: &ret})
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("unknown run %q", id), http.StatusNotFound)
+}
+
+// apiTokenHeader carries the API token for clients which can't use a bearer
+// token, as the Authorization header is used for basic auth.
+const apiTokenHeader = "X-API-Token"
+
+func requireBearerToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			got = r.Header.Get(apiTokenHeader)
+			ok = got != ""
+		}
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Failed to write JSON response")
+	}
+}
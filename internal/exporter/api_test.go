@@ -0,0 +1,211 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"speedtest-exporter/internal/result_store"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/showwin/speedtest-go/speedtest"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func getJSON(t *testing.T, h http.Handler, target string, v any) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	if rec.Code == http.StatusOK {
+		require.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), v))
+	}
+	return rec.Code
+}
+
+func TestLatestResultsHandler(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer:      NewTestClient(),
+		Ctx:       ctx,
+		ServerIDs: []int{1},
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+
+	var latest apiLatest
+	require.Equal(http.StatusOK, getJSON(t, e.LatestResultsHandler(), "/api/v1/results/latest", &latest))
+	assert.Nil(latest.LastAttempt)
+	assert.Empty(latest.Results)
+
+	e.UpdateResults()
+	require.Equal(http.StatusOK, getJSON(t, e.LatestResultsHandler(), "/api/v1/results/latest", &latest))
+	require.NotNil(latest.LastAttempt)
+	require.NotNil(latest.LastSuccess)
+	assert.Empty(latest.Error)
+	require.Len(latest.Results, 1)
+	require.Len(latest.Attempts, 1)
+	r := latest.Results[0]
+	assert.Equal("1", r.Server.ID)
+	assert.Equal("speedtest1.example.net:8080", r.Server.Host)
+	assert.True(r.Success)
+	require.NotNil(r.LatencySeconds)
+	assert.Greater(*r.LatencySeconds, 0.0)
+	require.NotNil(r.UploadBitsPerSecond)
+	assert.Greater(*r.UploadBitsPerSecond, 0.0)
+	assert.Greater(r.BytesUploaded, int64(0))
+	assert.Nil(r.PacketLossRatio)
+}
+
+func TestAPIResultPhases(t *testing.T) {
+	srv := &speedtest.Server{
+		ID:      "1",
+		Latency: 10 * time.Millisecond,
+		DLSpeed: 125000,
+		ULSpeed: 62500,
+	}
+	tests := []struct {
+		desc                     string
+		phases                   TestPhases
+		wantPing                 bool
+		wantDownload, wantUpload bool
+	}{
+		{"all", nil, true, true, true},
+		{"ping", TestPhases{PhasePing}, true, false, false},
+		{"download", TestPhases{PhaseDownload}, false, true, false},
+		{"throughput", TestPhases{PhaseDownload, PhaseUpload}, false, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			r := newAPIResult(Result{Server: srv, Phases: tt.phases})
+			assert.Equal(tt.wantPing, r.LatencySeconds != nil)
+			assert.Equal(tt.wantPing, r.JitterSeconds != nil)
+			assert.Equal(tt.wantPing, r.LatencyMinSeconds != nil)
+			assert.Equal(tt.wantPing, r.LatencyMaxSeconds != nil)
+			assert.Equal(tt.wantDownload, r.DownloadBitsPerSecond != nil)
+			assert.Equal(tt.wantUpload, r.UploadBitsPerSecond != nil)
+			if tt.wantPing {
+				assert.Equal(0.01, *r.LatencySeconds)
+			}
+			if tt.wantDownload {
+				assert.Equal(1e6, *r.DownloadBitsPerSecond)
+			}
+			if tt.wantUpload {
+				assert.Equal(5e5, *r.UploadBitsPerSecond)
+			}
+		})
+	}
+}
+
+func TestResultsHandler(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	var runs []apiRun
+	noHistory := New(Opts{})
+	assert.Equal(http.StatusNotFound, getJSON(t, noHistory.ResultsHandler(), "/api/v1/results", &runs))
+
+	e := New(Opts{
+		Doer:  NewTestClient(),
+		Ctx:   ctx,
+		Store: result_store.NewMemoryStore(result_store.Retention{}),
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	e.UpdateResults()
+	e.UpdateResults()
+
+	require.Equal(http.StatusOK, getJSON(t, e.ResultsHandler(), "/api/v1/results", &runs))
+	require.Len(runs, 2)
+	assert.True(runs[0].Finished.After(runs[1].Finished))
+	require.Len(runs[0].Results, 1)
+	assert.True(runs[0].Results[0].Success)
+
+	require.Equal(http.StatusOK, getJSON(t, e.ResultsHandler(), "/api/v1/results?limit=1", &runs))
+	require.Len(runs, 1)
+
+	assert.Equal(http.StatusBadRequest, getJSON(t, e.ResultsHandler(), "/api/v1/results?limit=x", &runs))
+}
+
+func TestRunHandler(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer:  NewTestClient(),
+		Ctx:   ctx,
+		Store: result_store.NewMemoryStore(result_store.Retention{}),
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	h := e.RunHandler("secret")
+
+	do := func(method, target, token string) (int, apiRunStatus) {
+		req := httptest.NewRequest(method, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var status apiRunStatus
+		if rec.Header().Get("Content-Type") == "application/json" {
+			require.NoError(json.Unmarshal(rec.Body.Bytes(), &status))
+		}
+		return rec.Code, status
+	}
+
+	code, _ := do(http.MethodPost, "/api/v1/run", "")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = do(http.MethodPost, "/api/v1/run", "wrong")
+	assert.Equal(http.StatusUnauthorized, code)
+	code, _ = do(http.MethodGet, "/api/v1/run", "secret")
+	assert.Equal(http.StatusBadRequest, code)
+
+	// the token can also be sent alongside basic auth credentials
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/run?id=missing", nil)
+	req.SetBasicAuth("user", "password")
+	req.Header.Set(apiTokenHeader, "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotFound, rec.Code)
+	code, _ = do(http.MethodGet, "/api/v1/run?id=missing", "secret")
+	assert.Equal(http.StatusNotFound, code)
+
+	code, triggered := do(http.MethodPost, "/api/v1/run", "secret")
+	require.Equal(http.StatusAccepted, code)
+	assert.Equal(RunStatusRunning, triggered.Status)
+	assert.False(triggered.Coalesced)
+
+	// triggering again while the run is in progress coalesces into it
+	code, coalesced := do(http.MethodPost, "/api/v1/run", "secret")
+	require.Equal(http.StatusAccepted, code)
+	assert.Equal(triggered.ID, coalesced.ID)
+	assert.True(coalesced.Coalesced)
+
+	var status apiRunStatus
+	require.Eventually(func() bool {
+		code, status = do(http.MethodGet, "/api/v1/run?id="+triggered.ID, "secret")
+		return code == http.StatusOK && status.Status == RunStatusFinished
+	}, 15*time.Second, 100*time.Millisecond)
+	require.NotNil(status.Run)
+	assert.Equal(triggered.ID, status.Run.ID)
+	require.Len(status.Run.Results, 1)
+	assert.True(status.Run.Results[0].Success)
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+}
+
+func TestRunHandlerWithoutToken(t *testing.T) {
+	e := New(Opts{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/run", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	e.RunHandler("").ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
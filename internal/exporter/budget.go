@@ -0,0 +1,61 @@
+package exporter
+
+import (
+	"errors"
+	"speedtest-exporter/internal/bandwidth_budget"
+	"speedtest-exporter/internal/bandwidth_observer"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrBudgetExhausted is the error of a run skipped to stay within the
+// bandwidth budget.
+var ErrBudgetExhausted = errors.New("skipped to stay within the bandwidth budget")
+
+var budget_remaining = prometheus.NewDesc(
+	prometheus.BuildFQName("speedtest", "", "bandwidth_budget_remaining_bytes"),
+	"Bytes left in the bandwidth budget for the current period",
+	nil,
+	nil,
+)
+
+// applyBudget adjusts spec for a run against the given number of servers to
+// stay within the bandwidth budget, if there is one, returning
+// ErrBudgetExhausted if the run should be skipped.
+func (e *SpeedtestExporter) applyBudget(spec testSpec, servers int) (testSpec, error) {
+	// Runs without throughput tests use next to no bandwidth.
+	if e.budget == nil || !(spec.phases.Has(PhaseDownload) || spec.phases.Has(PhaseUpload)) {
+		return spec, nil
+	}
+	switch e.budget.Decide(servers, spec.savingMode) {
+	case bandwidth_budget.DecisionSaving:
+		log.Info().
+			Int64("remaining_bytes", e.budget.Remaining()).
+			Msg("Bandwidth budget nearly used up, running speedtest in saving mode")
+		spec.savingMode = true
+	case bandwidth_budget.DecisionSkip:
+		log.Warn().
+			Int64("remaining_bytes", e.budget.Remaining()).
+			Msg("Skipping speedtest run to stay within the bandwidth budget")
+		e.budgetSkips.Inc()
+		return spec, ErrBudgetExhausted
+	}
+	return spec, nil
+}
+
+// recordUsage charges usage, the bytes transferred by a run which tested the
+// given number of servers according to spec, to the bandwidth budget, if
+// there is one. This covers all of the run's traffic, including server
+// discovery and pings, not just the download and upload tests.
+func (e *SpeedtestExporter) recordUsage(usage *bandwidth_observer.Usage, servers int, spec testSpec) {
+	if e.budget == nil {
+		return
+	}
+	bytes := usage.Downloaded() + usage.Uploaded()
+	// Partial runs say nothing about the cost of a full run.
+	if !spec.phases.full() {
+		servers = 0
+	}
+	e.budget.Record(bytes, servers, spec.savingMode)
+}
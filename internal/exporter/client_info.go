@@ -0,0 +1,47 @@
+package exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// newClientInfoDesc returns the desc of the speedtest_client_info metric,
+// which has an ip label if withIP is set.
+func newClientInfoDesc(withIP bool) *prometheus.Desc {
+	labels := []string{"isp", "country"}
+	if withIP {
+		labels = append(labels, "ip")
+	}
+	return prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", "client_info"),
+		"Info about the client as seen by speedtest.net, from the last server discovery",
+		labels,
+		nil,
+	)
+}
+
+// setClient records the client info fetched during server discovery,
+// counting a change of ISP from the previously fetched info.
+func (e *SpeedtestExporter) setClient(user *speedtest.User) {
+	prev := e.client.Swap(user)
+	if prev != nil && prev.Isp != user.Isp {
+		log.Info().
+			Str("previous_isp", prev.Isp).
+			Str("isp", user.Isp).
+			Msg("ISP changed")
+		e.ispChanges.Inc()
+	}
+}
+
+func (e *SpeedtestExporter) collectClientInfo(ch chan<- prometheus.Metric) {
+	user := e.client.Load()
+	if user == nil {
+		return
+	}
+	labels := []string{user.Isp, user.Country}
+	if e.exportClientIP {
+		labels = append(labels, user.IP)
+	}
+	ch <- prometheus.MustNewConstMetric(e.clientInfo, prometheus.GaugeValue, 1, labels...)
+}
@@ -0,0 +1,68 @@
+package exporter
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/showwin/speedtest-go/speedtest"
+	"github.com/tj/assert"
+)
+
+func TestClientInfo(t *testing.T) {
+	tests := []struct {
+		desc string
+		ip   bool
+		want string
+	}{
+		{"without_ip", false, `
+# HELP speedtest_client_info Info about the client as seen by speedtest.net, from the last server discovery
+# TYPE speedtest_client_info gauge
+speedtest_client_info{country="US",isp="Dat Sponsor Doh"} 1
+`},
+		{"with_ip", true, `
+# HELP speedtest_client_info Info about the client as seen by speedtest.net, from the last server discovery
+# TYPE speedtest_client_info gauge
+speedtest_client_info{country="US",ip="1.2.3.4",isp="Dat Sponsor Doh"} 1
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			e := New(Opts{
+				Doer:           NewTestClient(),
+				Ctx:            ctx,
+				ExportClientIP: tt.ip,
+			})
+			// not exported before the first server discovery
+			assert.Equal(0, testutil.CollectAndCount(e, "speedtest_client_info"))
+
+			_, err := e.fetchClient(ctx)
+			assert.NoError(err)
+			assert.NoError(testutil.CollectAndCompare(e, strings.NewReader(tt.want), "speedtest_client_info"))
+		})
+	}
+}
+
+func TestISPChanges(t *testing.T) {
+	assert := assert.New(t)
+	e := New(Opts{})
+	e.setClient(&speedtest.User{Isp: "Fibre Co", Country: "US"})
+	assert.Equal(0.0, testutil.ToFloat64(e.ispChanges))
+	// a new IP from the same ISP isn't a change
+	e.setClient(&speedtest.User{Isp: "Fibre Co", Country: "US", IP: "1.2.3.5"})
+	assert.Equal(0.0, testutil.ToFloat64(e.ispChanges))
+	e.setClient(&speedtest.User{Isp: "LTE Co", Country: "US"})
+	assert.Equal(1.0, testutil.ToFloat64(e.ispChanges))
+	e.setClient(&speedtest.User{Isp: "Fibre Co", Country: "US"})
+	assert.Equal(2.0, testutil.ToFloat64(e.ispChanges))
+	assert.NoError(testutil.CollectAndCompare(e, strings.NewReader(`
+# HELP speedtest_client_info Info about the client as seen by speedtest.net, from the last server discovery
+# TYPE speedtest_client_info gauge
+speedtest_client_info{country="US",isp="Fibre Co"} 1
+`), "speedtest_client_info"))
+}
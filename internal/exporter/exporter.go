@@ -4,72 +4,292 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"slices"
+	"speedtest-exporter/internal/bandwidth_budget"
+	"speedtest-exporter/internal/bandwidth_observer"
+	"speedtest-exporter/internal/metric_schema"
+	"speedtest-exporter/internal/result_store"
+	"speedtest-exporter/internal/scheduler"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"github.com/showwin/speedtest-go/speedtest"
+	"github.com/showwin/speedtest-go/speedtest/transport"
 )
 
 var (
-	latency = prometheus.NewDesc(
-		prometheus.BuildFQName("speedtest", "", "latency_ms"),
-		"Latency to Speedtest Server in seconds",
-		[]string{"server_id", "url", "name", "country", "sponsor", "lat", "lon", "distance"},
+	last_success = prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", "last_success_timestamp_seconds"),
+		"Unix timestamp of the last speedtest run with at least one successful server",
+		nil,
 		nil,
 	)
-	dl_speed = prometheus.NewDesc(
-		prometheus.BuildFQName("speedtest", "", "download_speed_mbps"),
-		"Latency to Speedtest Server in seconds",
-		[]string{"server_id", "url", "name", "country", "sponsor", "lat", "lon", "distance"},
+	last_attempt = prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", "last_attempt_timestamp_seconds"),
+		"Unix timestamp of the last speedtest run, successful or not",
+		nil,
 		nil,
 	)
-	ul_speed = prometheus.NewDesc(
-		prometheus.BuildFQName("speedtest", "", "upload_speed_mbps"),
-		"Latency to Speedtest Server in seconds",
-		[]string{"server_id", "url", "name", "country", "sponsor", "lat", "lon", "distance"},
+	next_run = prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", "next_run_timestamp_seconds"),
+		"Unix timestamp of the next scheduled speedtest run",
+		nil,
 		nil,
 	)
 )
 
+// Result is the outcome of a speedtest run against a single server.
+type Result struct {
+	Server    *speedtest.Server `json:"server"`
+	Error     string            `json:"error,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+	// BytesDownloaded and BytesUploaded are the totals transferred by the
+	// download and upload tests.
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+	BytesUploaded   int64 `json:"bytes_uploaded"`
+	// PingMode is how the server's latency was measured.
+	PingMode PingMode `json:"ping_mode,omitempty"`
+	// Phases are the phases the test ran. Empty if it ran every phase, as
+	// results recorded before phases could be selected did.
+	Phases TestPhases `json:"phases,omitempty"`
+}
+
+func (r Result) Success() bool {
+	return r.Error == ""
+}
+
+// pingMode returns how the result's latency was measured. Results recorded
+// before ping modes were added used HTTP.
+func (r Result) pingMode() PingMode {
+	if r.PingMode == "" {
+		return PingModeHTTP
+	}
+	return r.PingMode
+}
+
+type cacheEntry struct {
+	// attempt is the result of the most recent test against this server.
+	attempt Result
+	// good is the most recent successful result for this server, if any.
+	good *Result
+}
+
+// ResultCache holds the results of the most recent speedtest run. Failed
+// attempts don't evict previously successful results, which are instead
+// retained until they're older than maxAge.
 type ResultCache struct {
-	results speedtest.Servers
-	mut     sync.RWMutex
+	entries     []cacheEntry
+	lastAttempt time.Time
+	lastSuccess time.Time
+	// lastError is why the most recent run failed before testing any server.
+	lastError string
+	maxAge    time.Duration
+	mut       sync.RWMutex
+}
+
+// Set records the results of a run. Servers which weren't part of this run
+// are dropped, while servers whose test failed keep their last good result.
+func (r *ResultCache) Set(results []Result) {
+	r.set(results, time.Now())
+}
+
+// SetFailed records a run which failed before any server could be tested.
+func (r *ResultCache) SetFailed(err error) {
+	r.setFailed(err.Error(), time.Now())
 }
 
-func (r *ResultCache) Set(servers speedtest.Servers) {
+// Restore replays a previously recorded run into the cache. Skipped runs are
+// ignored, as they were when they were recorded.
+func (r *ResultCache) Restore(run Run) {
+	if run.Skipped {
+		return
+	}
+	if len(run.Results) == 0 {
+		r.setFailed(run.Error, run.Finished)
+		return
+	}
+	r.set(run.Results, run.Finished)
+}
+
+func (r *ResultCache) set(results []Result, now time.Time) {
 	r.mut.Lock()
 	defer r.mut.Unlock()
-	r.results = servers
+	entries := make([]cacheEntry, 0, len(results))
+	for _, res := range results {
+		entry := cacheEntry{attempt: res}
+		if res.Success() {
+			good := res
+			entry.good = &good
+			r.lastSuccess = now
+		} else {
+			entry.good = r.lastGood(res.Server.ID)
+		}
+		entries = append(entries, entry)
+	}
+	r.entries = entries
+	r.lastAttempt = now
+	r.lastError = ""
+}
+
+func (r *ResultCache) setFailed(err string, now time.Time) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.lastAttempt = now
+	r.lastError = err
+}
+
+func (r *ResultCache) lastGood(serverID string) *Result {
+	for _, entry := range r.entries {
+		if entry.attempt.Server.ID == serverID {
+			return entry.good
+		}
+	}
+	return nil
+}
+
+// Get returns the last good result for each server, omitting any older than
+// the cache's max age.
+func (r *ResultCache) Get() []Result {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	results := []Result{}
+	for _, entry := range r.entries {
+		if entry.good == nil {
+			continue
+		}
+		if r.maxAge > 0 && time.Since(entry.good.Timestamp) > r.maxAge {
+			continue
+		}
+		results = append(results, *entry.good)
+	}
+	return results
+}
+
+// Attempts returns the result of the most recent test against each server.
+func (r *ResultCache) Attempts() []Result {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	results := make([]Result, 0, len(r.entries))
+	for _, entry := range r.entries {
+		results = append(results, entry.attempt)
+	}
+	return results
+}
+
+// LastAttempt returns the time of the most recent run, successful or not.
+func (r *ResultCache) LastAttempt() time.Time {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.lastAttempt
+}
+
+// LastSuccess returns the time of the most recent run in which at least one
+// server was tested successfully.
+func (r *ResultCache) LastSuccess() time.Time {
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.lastSuccess
 }
 
-func (r *ResultCache) Get() speedtest.Servers {
+// LastError returns why the most recent run failed before any server could be
+// tested, or an empty string if it didn't.
+func (r *ResultCache) LastError() string {
 	r.mut.RLock()
 	defer r.mut.RUnlock()
-	return r.results
+	return r.lastError
 }
 
-func NewResultCache() *ResultCache {
+// SetMaxAge changes how long successful results are retained for.
+func (r *ResultCache) SetMaxAge(maxAge time.Duration) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.maxAge = maxAge
+}
+
+func NewResultCache(maxAge time.Duration) *ResultCache {
 	return &ResultCache{
-		results: speedtest.Servers{},
+		entries: []cacheEntry{},
+		maxAge:  maxAge,
 		mut:     sync.RWMutex{},
 	}
 }
 
+// TestMode controls what triggers a speedtest run.
+type TestMode string
+
+const (
+	// TestModeInterval runs speedtests on a fixed interval from TestLoop.
+	TestModeInterval TestMode = "interval"
+	// TestModeScrape runs a speedtest when the exporter is scraped and the
+	// cached results are older than the configured minimum age.
+	TestModeScrape TestMode = "scrape"
+)
+
+// ParseTestMode parses a TestMode from its string representation.
+func ParseTestMode(s string) (TestMode, error) {
+	switch mode := TestMode(s); mode {
+	case TestModeInterval, TestModeScrape:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown test mode %q", s)
+}
+
+func (m TestMode) MarshalText() ([]byte, error) {
+	return []byte(m), nil
+}
+
+func (m *TestMode) UnmarshalText(text []byte) error {
+	mode, err := ParseTestMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
 type SpeedtestExporter struct {
-	ctx          context.Context
-	done         chan struct{}
-	speedtest    *speedtest.Speedtest
-	cache        *ResultCache
-	testInterval time.Duration
-	testTimeout  time.Duration
-	savingMode   bool
-
-	testDuration      prometheus.Gauge
+	ctx       context.Context
+	done      chan struct{}
+	speedtest *speedtest.Speedtest
+	cache     *ResultCache
+	testMode  TestMode
+	runs      singleFlight
+	testSlot  chan struct{}
+	schema    metric_schema.Schema
+	metrics   *resultMetrics
+	store     result_store.Store
+	budget    *bandwidth_budget.Budget
+	// settings holds the options which can be changed by Reload.
+	settings    settings
+	settingsMut sync.RWMutex
+	reloaded    chan struct{}
+	// nextRun is when TestLoop will next run a speedtest, in Unix nanoseconds.
+	nextRun atomic.Int64
+	// lastSkip is when a run was last skipped by an ISP policy or the
+	// bandwidth budget, in Unix nanoseconds.
+	lastSkip atomic.Int64
+	// client is the client info fetched by the last server discovery.
+	client         atomic.Pointer[speedtest.User]
+	clientInfo     *prometheus.Desc
+	exportClientIP bool
+
+	// timers record the durations of scheduled, scraped and triggered runs.
+	// Probes record theirs separately.
+	timers            *runTimers
 	getTargetDuration prometheus.Gauge
+	targetUpdateTime  prometheus.Histogram
 	testErrors        prometheus.Counter
 	testsRun          prometheus.Counter
+	serverFallbacks   *prometheus.CounterVec
+	budgetSkips       prometheus.Counter
+	runBytes          *prometheus.GaugeVec
+	ispChanges        prometheus.Counter
+	ispPolicySkips    prometheus.Counter
 }
 
 type Opts struct {
@@ -77,7 +297,128 @@ type Opts struct {
 	Doer         *http.Client
 	TestTimeout  time.Duration
 	TestInterval time.Duration
-	SavingMode   bool
+	// Schedule decides when TestLoop runs speedtests. It overrides
+	// TestInterval, and defaults to running every TestInterval.
+	Schedule   *scheduler.Scheduler
+	SavingMode bool
+	// ServerIDs pins the speedtest servers to test against. When empty, the
+	// closest servers are used.
+	ServerIDs []int
+	// ServerCount is the number of closest servers to test against when no
+	// servers are pinned.
+	ServerCount int
+	// ResultMaxAge is how long a successful result is exported for when
+	// subsequent runs fail. Zero retains results indefinitely.
+	ResultMaxAge time.Duration
+	// TestMode selects whether speedtests run on an interval or are
+	// triggered by scrapes. Defaults to TestModeInterval.
+	TestMode TestMode
+	// TestMinAge is, in scrape mode, how old the last run must be before a
+	// scrape triggers a new one.
+	TestMinAge time.Duration
+	// PacketLossDuration is how long to sample packet loss for during each
+	// test. Zero disables packet loss analysis.
+	PacketLossDuration time.Duration
+	// PingMode selects how server latency is measured. Defaults to
+	// PingModeHTTP.
+	PingMode PingMode
+	// PingCount is the number of pings sent to each server. Defaults to 10.
+	PingCount int
+	// Phases are the phases of each speedtest to run. Defaults to every
+	// phase.
+	Phases TestPhases
+	// MetricSchema selects the names and units of exported metrics. Defaults
+	// to metric_schema.V1.
+	MetricSchema metric_schema.Schema
+	// Store, if set, records the history of speedtest runs. The cache is
+	// restored from it on startup.
+	Store result_store.Store
+	// Budget, if set, limits the bandwidth used by speedtests, switching to
+	// saving mode or skipping runs as it runs out. Usage is measured by a
+	// bandwidth_observer.BandwidthObserver, which must wrap Doer's transport.
+	Budget *bandwidth_budget.Budget
+	// ServerLabels are the labels identifying servers on per-server metrics.
+	// Defaults to DefaultServerLabels for MetricSchema.
+	ServerLabels []string
+	// ExportClientIP adds the client's public IP address to
+	// speedtest_client_info.
+	ExportClientIP bool
+	// ISPRules adjust how speedtests are run while the client's ISP matches
+	// them. The first matching rule applies.
+	ISPRules []ISPRule
+}
+
+// ParseServerIDs parses a comma separated list of speedtest server IDs,
+// rejecting duplicates as the config file does.
+func ParseServerIDs(s string) ([]int, error) {
+	ids := []int{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server id %q: %w", field, err)
+		}
+		if slices.Contains(ids, id) {
+			return nil, fmt.Errorf("duplicate server id %d", id)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// settings are the options of an exporter which can be changed while it's
+// running.
+type settings struct {
+	schedule    *scheduler.Scheduler
+	testTimeout time.Duration
+	savingMode  bool
+	serverIDs   []int
+	serverCount int
+	testMinAge  time.Duration
+	packetLoss  time.Duration
+	pingMode    PingMode
+	pingCount   int
+	ispRules    []ISPRule
+	phases      TestPhases
+}
+
+func newSettings(opts Opts) settings {
+	ret := settings{
+		schedule:    opts.Schedule,
+		testTimeout: opts.TestTimeout,
+		savingMode:  opts.SavingMode,
+		serverIDs:   opts.ServerIDs,
+		serverCount: opts.ServerCount,
+		testMinAge:  opts.TestMinAge,
+		packetLoss:  opts.PacketLossDuration,
+		pingMode:    opts.PingMode,
+		pingCount:   opts.PingCount,
+		ispRules:    opts.ISPRules,
+		phases:      opts.Phases.normalize(),
+	}
+	if ret.pingMode == "" {
+		ret.pingMode = PingModeHTTP
+	}
+	if ret.pingCount == 0 {
+		ret.pingCount = defaultPingCount
+	}
+	if ret.testTimeout == 0 {
+		ret.testTimeout = 1 * time.Minute
+	}
+	if ret.schedule == nil {
+		interval := opts.TestInterval
+		if interval == 0 {
+			interval = 1 * time.Hour
+		}
+		ret.schedule = scheduler.Every(interval)
+	}
+	if ret.serverCount == 0 {
+		ret.serverCount = 1
+	}
+	return ret
 }
 
 func New(opts Opts) *SpeedtestExporter {
@@ -87,26 +428,33 @@ func New(opts Opts) *SpeedtestExporter {
 	if opts.Doer == nil {
 		opts.Doer = http.DefaultClient
 	}
-	if opts.TestTimeout == 0 {
-		opts.TestTimeout = 1 * time.Minute
+	if opts.TestMode == "" {
+		opts.TestMode = TestModeInterval
 	}
-	if opts.TestInterval == 0 {
-		opts.TestInterval = 1 * time.Hour
+	if opts.MetricSchema == "" {
+		opts.MetricSchema = metric_schema.V1
 	}
 	ret := SpeedtestExporter{
-		ctx:          opts.Ctx,
-		speedtest:    speedtest.New(speedtest.WithDoer(opts.Doer)),
-		cache:        NewResultCache(),
-		testTimeout:  opts.TestTimeout,
-		testInterval: opts.TestInterval,
-		savingMode:   opts.SavingMode,
-		testDuration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "speedtest_test_duration_ms",
-			Help: "Duration of speedtest runs in seconds",
-		}),
-		getTargetDuration: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "speedtest_target_update_duration_ms",
-			Help: "Duration of speedtest runs in seconds",
+		ctx:       opts.Ctx,
+		done:      make(chan struct{}),
+		testSlot:  make(chan struct{}, 1),
+		speedtest: speedtest.New(speedtest.WithDoer(opts.Doer)),
+		cache:     NewResultCache(opts.ResultMaxAge),
+		testMode:  opts.TestMode,
+		settings:  newSettings(opts),
+		reloaded:  make(chan struct{}, 1),
+		schema:    opts.MetricSchema,
+		metrics:   newResultMetrics(opts.MetricSchema, opts.ServerLabels),
+		store:     opts.Store,
+		budget:    opts.Budget,
+
+		clientInfo:     newClientInfoDesc(opts.ExportClientIP),
+		exportClientIP: opts.ExportClientIP,
+		timers:         newRunTimers(opts.MetricSchema),
+		targetUpdateTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "speedtest_target_update_duration_seconds",
+			Help:    "Duration of speedtest server discovery in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 8),
 		}),
 		testErrors: prometheus.NewCounter(prometheus.CounterOpts{
 			Name: "speedtest_test_errors_total",
@@ -116,126 +464,523 @@ func New(opts Opts) *SpeedtestExporter {
 			Name: "speedtest_tests_run_total",
 			Help: "Number of speedtest runs",
 		}),
+		serverFallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "speedtest_server_fallbacks_total",
+			Help: "Number of times a pinned server was not found and the closest server was used instead",
+		}, []string{"server_id"}),
+		budgetSkips: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "speedtest_bandwidth_budget_skipped_runs_total",
+			Help: "Number of speedtest runs skipped to stay within the bandwidth budget",
+		}),
+		runBytes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "speedtest_last_run_bytes",
+			Help: "Bytes transferred by the last speedtest run, including server discovery, as measured by the HTTP client",
+		}, []string{"direction"}),
+		ispChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "speedtest_client_isp_changes_total",
+			Help: "Number of times the client's ISP changed between server discoveries",
+		}),
+		ispPolicySkips: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "speedtest_isp_policy_skipped_runs_total",
+			Help: "Number of speedtest runs skipped by ISP policy intervals",
+		}),
+	}
+	// v2 supersedes this with the speedtest_target_update_duration_seconds
+	// histogram.
+	if opts.MetricSchema != metric_schema.V2 {
+		// v1 names this in milliseconds, but it's always been set in seconds.
+		ret.getTargetDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "speedtest_target_update_duration_ms",
+			Help: "Duration of the last speedtest server discovery in seconds",
+		})
 	}
+	ret.restoreRuns()
 	return &ret
 }
 
+// Reload applies the test interval and schedule, test timeout, saving mode,
+// server selection, result max age, test min age, packet loss duration, ping
+// mode, ping count, test phases and ISP rules from opts to a running exporter,
+// without dropping cached results. Other options can't be changed once the
+// exporter is created, and are ignored.
+func (e *SpeedtestExporter) Reload(opts Opts) {
+	e.settingsMut.Lock()
+	e.settings = newSettings(opts)
+	e.settingsMut.Unlock()
+	e.cache.SetMaxAge(opts.ResultMaxAge)
+	// Wake TestLoop so it picks up the new interval.
+	select {
+	case e.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+func (e *SpeedtestExporter) currentSettings() settings {
+	e.settingsMut.RLock()
+	defer e.settingsMut.RUnlock()
+	return e.settings
+}
+
 func (e *SpeedtestExporter) Describe(ch chan<- *prometheus.Desc) {
-	ch <- latency
-	ch <- dl_speed
-	ch <- ul_speed
-	ch <- e.testDuration.Desc()
-	ch <- e.getTargetDuration.Desc()
+	e.metrics.Describe(ch)
+	ch <- server_info
+	ch <- server_distance
+	ch <- last_success
+	ch <- last_attempt
+	ch <- next_run
+	e.timers.Describe(ch)
+	if e.getTargetDuration != nil {
+		ch <- e.getTargetDuration.Desc()
+	}
+	ch <- e.targetUpdateTime.Desc()
 	ch <- e.testErrors.Desc()
+	ch <- e.testsRun.Desc()
+	e.serverFallbacks.Describe(ch)
+	ch <- budget_remaining
+	ch <- e.budgetSkips.Desc()
+	e.runBytes.Describe(ch)
+	ch <- e.clientInfo
+	ch <- e.ispChanges.Desc()
+	ch <- isp_policy
+	ch <- e.ispPolicySkips.Desc()
 }
 
 func (e *SpeedtestExporter) Collect(ch chan<- prometheus.Metric) {
-	ch <- e.testDuration
-	ch <- e.getTargetDuration
-	for _, s := range e.cache.Get() {
-		ch <- prometheus.MustNewConstMetric(
-			latency,
-			prometheus.GaugeValue,
-			float64(s.Latency.Microseconds())/1000,
-			s.ID, s.URL, s.Name, s.Country, s.Sponsor, s.Lat, s.Lon, fmt.Sprintf("%f", s.Distance),
-		)
-		ch <- prometheus.MustNewConstMetric(
-			dl_speed,
-			prometheus.GaugeValue,
-			float64(s.DLSpeed),
-			s.ID, s.URL, s.Name, s.Country, s.Sponsor, s.Lat, s.Lon, fmt.Sprintf("%f", s.Distance),
-		)
-		ch <- prometheus.MustNewConstMetric(
-			ul_speed,
-			prometheus.GaugeValue,
-			float64(s.ULSpeed),
-			s.ID, s.URL, s.Name, s.Country, s.Sponsor, s.Lat, s.Lon, fmt.Sprintf("%f", s.Distance),
-		)
-	}
-}
-
-func (e *SpeedtestExporter) getServers() (speedtest.Servers, error) {
-	timer := prometheus.NewTimer(prometheus.ObserverFunc(e.getTargetDuration.Set))
-	defer timer.ObserveDuration()
-	infoCtx, cancel := context.WithTimeout(e.ctx, 1500*time.Millisecond)
-	defer cancel()
+	if e.testMode == TestModeScrape && time.Since(e.lastRun()) >= e.currentSettings().testMinAge {
+		e.UpdateResults()
+	}
+	e.timers.Collect(ch)
+	if e.getTargetDuration != nil {
+		ch <- e.getTargetDuration
+	}
+	ch <- e.targetUpdateTime
+	ch <- e.testErrors
+	ch <- e.testsRun
+	e.serverFallbacks.Collect(ch)
+	e.runBytes.Collect(ch)
+	e.collectClientInfo(ch)
+	ch <- e.ispChanges
+	if rules := e.currentSettings().ispRules; len(rules) > 0 {
+		e.collectISPPolicy(ch, rules)
+		ch <- e.ispPolicySkips
+	}
+	if t := e.cache.LastAttempt(); !t.IsZero() {
+		ch <- prometheus.MustNewConstMetric(last_attempt, prometheus.GaugeValue, float64(t.UnixNano())/1e9)
+	}
+	if t := e.cache.LastSuccess(); !t.IsZero() {
+		ch <- prometheus.MustNewConstMetric(last_success, prometheus.GaugeValue, float64(t.UnixNano())/1e9)
+	}
+	if t := e.nextRun.Load(); t != 0 {
+		ch <- prometheus.MustNewConstMetric(next_run, prometheus.GaugeValue, float64(t)/1e9)
+	}
+	if e.budget != nil {
+		ch <- prometheus.MustNewConstMetric(budget_remaining, prometheus.GaugeValue, float64(e.budget.Remaining()))
+		ch <- e.budgetSkips
+	}
+	for _, r := range e.cache.Attempts() {
+		success := 0.0
+		if r.Success() {
+			success = 1
+		}
+		ch <- prometheus.MustNewConstMetric(e.metrics.success, prometheus.GaugeValue, success, e.metrics.labelValues(r.Server)...)
+		collectServerInfo(ch, r.Server)
+	}
+	for _, r := range e.cache.Get() {
+		e.metrics.collect(ch, r)
+	}
+}
+
+// lastRun returns when a run was last attempted or skipped. In scrape mode,
+// skipped runs count towards the test minimum age, so scrapes while a run is
+// deferred don't look up the client each time.
+func (e *SpeedtestExporter) lastRun() time.Time {
+	last := e.cache.LastAttempt()
+	if t := e.lastSkip.Load(); t != 0 && time.Unix(0, t).After(last) {
+		return time.Unix(0, t)
+	}
+	return last
+}
 
-	user, err := e.speedtest.FetchUserInfoContext(infoCtx)
+// getServers fetches the server list and selects the servers to test from it.
+// The client must have been fetched first, so the list is sorted by distance.
+func (e *SpeedtestExporter) getServers(ctx context.Context) (speedtest.Servers, error) {
+	serverList, err := e.fetchServerList(ctx)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug().Interface("user", user).Msg("Fetched user info")
 
-	listCtx, cancel := context.WithTimeout(e.ctx, 1500*time.Millisecond)
+	targets, err := e.selectServers(serverList)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Interface("targets", targets).Msg("Found targets")
+	return targets, nil
+}
+
+// fetchServerList fetches the list of speedtest servers near the caller,
+// sorted by distance. Distances are only known once the client has been
+// fetched with fetchClient.
+func (e *SpeedtestExporter) fetchServerList(ctx context.Context) (speedtest.Servers, error) {
+	listCtx, cancel := context.WithTimeout(bandwidth_observer.WithPhase(ctx, PhaseServerList), 1500*time.Millisecond)
 	defer cancel()
 	serverList, err := e.speedtest.FetchServerListContext(listCtx)
 	if err != nil {
 		return nil, err
 	}
 	log.Debug().Interface("serverList", serverList).Msg("Fetched server list")
+	return serverList, nil
+}
 
-	targets, err := serverList.FindServer([]int{})
+// fetchClient fetches the client's info, including its ISP, as seen by
+// speedtest.net.
+func (e *SpeedtestExporter) fetchClient(ctx context.Context) (*speedtest.User, error) {
+	ctx, cancel := context.WithTimeout(bandwidth_observer.WithPhase(ctx, PhaseConfig), 1500*time.Millisecond)
+	defer cancel()
+	user, err := e.speedtest.FetchUserInfoContext(ctx)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug().Interface("targets", targets).Msg("Found targets")
+	log.Debug().Interface("user", user).Msg("Fetched user info")
+	e.setClient(user)
+	return user, nil
+}
+
+// selectServers resolves the pinned server IDs against serverList, falling
+// back to the closest servers for any pinned ID which isn't in the list. When
+// no servers are pinned, the closest serverCount servers are selected.
+func (e *SpeedtestExporter) selectServers(serverList speedtest.Servers) (speedtest.Servers, error) {
+	settings := e.currentSettings()
+	if len(settings.serverIDs) == 0 {
+		return closestServers(serverList, settings.serverCount, nil)
+	}
+	targets := speedtest.Servers{}
+	missing := 0
+	for _, id := range settings.serverIDs {
+		srv := findServerByID(serverList, strconv.Itoa(id))
+		if srv == nil {
+			log.Warn().
+				Int("server_id", id).
+				Msg("Pinned server not found in server list, falling back to closest server")
+			e.serverFallbacks.WithLabelValues(strconv.Itoa(id)).Inc()
+			missing++
+			continue
+		}
+		targets = append(targets, srv)
+	}
+	if missing > 0 {
+		closest, err := closestServers(serverList, missing, targets)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, closest...)
+	}
+	if len(targets) == 0 {
+		return nil, speedtest.ErrServerNotFound
+	}
 	return targets, nil
 }
 
-func (e *SpeedtestExporter) RunSpeedtest(targets speedtest.Servers) error {
+// closestServers returns the n closest servers in servers which responded to
+// the discovery ping, skipping any server already in exclude. speedtest-go
+// sorts the server list by distance.
+func closestServers(servers speedtest.Servers, n int, exclude speedtest.Servers) (speedtest.Servers, error) {
+	candidates := servers.Available().Filter(func(s *speedtest.Server) bool {
+		return findServerByID(exclude, s.ID) == nil
+	})
+	if len(candidates) == 0 {
+		if len(exclude) > 0 {
+			return speedtest.Servers{}, nil
+		}
+		// No server responded to the initial ping, let speedtest-go pick.
+		return servers.FindServer([]int{})
+	}
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	return candidates[:n], nil
+}
+
+func findServerByID(servers speedtest.Servers, id string) *speedtest.Server {
+	for _, srv := range servers {
+		if srv.ID == id {
+			return srv
+		}
+	}
+	return nil
+}
+
+// testSpec describes how a speedtest run should be carried out.
+type testSpec struct {
+	savingMode bool
+	// packetLoss is how long to sample packet loss for, zero skips it.
+	packetLoss time.Duration
+	pingMode   PingMode
+	pingCount  int
+	// phases are the phases to run, empty runs every phase.
+	phases TestPhases
+}
+
+func (e *SpeedtestExporter) defaultSpec() testSpec {
+	settings := e.currentSettings()
+	return testSpec{
+		savingMode: settings.savingMode,
+		packetLoss: settings.packetLoss,
+		pingMode:   settings.pingMode,
+		pingCount:  settings.pingCount,
+		phases:     settings.phases,
+	}
+}
+
+// expectedServerCount returns the number of servers a run is expected to test.
+func (e *SpeedtestExporter) expectedServerCount() int {
+	settings := e.currentSettings()
+	if len(settings.serverIDs) > 0 {
+		return len(settings.serverIDs)
+	}
+	return settings.serverCount
+}
+
+// acquireTester blocks until no other speedtest is running, as concurrent
+// tests would compete for bandwidth and share speedtest-go's data manager.
+func (e *SpeedtestExporter) acquireTester(ctx context.Context) error {
+	select {
+	case e.testSlot <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *SpeedtestExporter) releaseTester() {
+	<-e.testSlot
+}
+
+// RunSpeedtest tests each of targets in turn, returning a Result for each.
+// A failure against one server doesn't prevent testing the rest.
+func (e *SpeedtestExporter) RunSpeedtest(targets speedtest.Servers) []Result {
+	return e.runSpeedtest(e.ctx, targets, e.defaultSpec(), e.timers)
+}
+
+// runSpeedtest tests each of targets according to spec, recording the
+// durations of the run on timers.
+func (e *SpeedtestExporter) runSpeedtest(ctx context.Context, targets speedtest.Servers, spec testSpec, timers *runTimers) []Result {
+	timer := prometheus.NewTimer(prometheus.ObserverFunc(timers.testDuration.Set))
+	defer timer.ObserveDuration()
+	// Saving mode limits speedtest-go to a single connection, zero restores
+	// its default of one per CPU.
+	if spec.savingMode {
+		e.speedtest.SetNThread(1)
+	} else {
+		e.speedtest.SetNThread(0)
+	}
+	results := make([]Result, 0, len(targets))
 	for _, srv := range targets {
-		timer := prometheus.NewTimer(prometheus.ObserverFunc(e.testDuration.Set))
-		defer timer.ObserveDuration()
-		ctx, cancel := context.WithTimeout(e.ctx, e.testTimeout)
-		defer cancel()
-		err := srv.PingTestContext(ctx, func(time.Duration) {})
-		if err != nil {
-			return err
+		r := Result{Server: srv, PingMode: spec.pingMode, Phases: spec.phases}
+		if err := e.testServer(ctx, srv, spec, timers); err != nil {
+			log.Error().Err(err).Str("server_id", srv.ID).Msg("Failed to run speedtest")
+			e.testErrors.Inc()
+			r.Error = err.Error()
 		}
-		err = srv.DownloadTestContext(ctx)
+		r.Timestamp = time.Now()
+		r.BytesDownloaded = e.speedtest.GetTotalDownload()
+		r.BytesUploaded = e.speedtest.GetTotalUpload()
+		results = append(results, r)
+	}
+	return results
+}
+
+func (e *SpeedtestExporter) testServer(ctx context.Context, srv *speedtest.Server, spec testSpec, timers *runTimers) error {
+	// Reset the data manager so handlers and totals from previous servers
+	// don't leak into this test.
+	e.speedtest.Reset()
+	ctx, cancel := context.WithTimeout(bandwidth_observer.WithServerID(ctx, srv.ID), e.currentSettings().testTimeout)
+	defer cancel()
+	if spec.phases.Has(PhasePing) {
+		err := timers.timePhase(ctx, PhasePing, func(ctx context.Context) error {
+			rtt := timers.pingRTT.WithLabelValues(srv.ID, string(spec.pingMode))
+			return pingServer(ctx, srv, spec.pingMode, spec.pingCount, func(d time.Duration) {
+				rtt.Observe(d.Seconds())
+			})
+		})
 		if err != nil {
 			return err
 		}
-		err = srv.UploadTestContext(ctx)
+	}
+	if spec.packetLoss > 0 {
+		_ = timers.timePhase(ctx, PhasePacketLoss, func(ctx context.Context) error {
+			measurePacketLoss(ctx, srv, spec.packetLoss)
+			return nil
+		})
+	}
+	if spec.phases.Has(PhaseDownload) {
+		err := timers.timePhase(ctx, PhaseDownload, func(ctx context.Context) error {
+			return srv.DownloadTestContext(ctx)
+		})
 		if err != nil {
 			return err
 		}
 	}
+	if spec.phases.Has(PhaseUpload) {
+		return timers.timePhase(ctx, PhaseUpload, func(ctx context.Context) error {
+			return srv.UploadTestContext(ctx)
+		})
+	}
 	return nil
 }
 
-func (e *SpeedtestExporter) UpdateResults() {
-	log.Debug().Msg("Collecting Speedtest Target")
-	targets, err := e.getServers()
+// Phases of a speedtest run against a single server.
+const (
+	PhasePing       = "ping"
+	PhasePacketLoss = "packet_loss"
+	PhaseDownload   = "download"
+	PhaseUpload     = "upload"
+)
+
+// Phases of server discovery, before any server is tested. Their traffic is
+// attributed to these phases, but their durations are recorded by
+// speedtest_target_update_duration_seconds.
+const (
+	PhaseConfig     = "config"
+	PhaseServerList = "server_list"
+)
+
+// measurePacketLoss samples packet loss to srv for the given duration. Not all
+// servers support packet loss analysis, so failures are logged rather than
+// failing the test.
+func measurePacketLoss(ctx context.Context, srv *speedtest.Server, duration time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+	analyzer := speedtest.NewPacketLossAnalyzer(&speedtest.PacketLossAnalyzerOptions{
+		SamplingDuration: duration,
+	})
+	err := analyzer.RunWithContext(ctx, srv.Host, func(pl *transport.PLoss) {
+		srv.PacketLoss = *pl
+	})
 	if err != nil {
-		e.cache.Set(speedtest.Servers{})
+		log.Warn().Err(err).Str("server_id", srv.ID).Msg("Failed to measure packet loss")
+	}
+}
+
+// UpdateResults runs a speedtest and updates the cached results. If a run is
+// already in progress, it waits for that run to finish instead of starting
+// another.
+func (e *SpeedtestExporter) UpdateResults() {
+	id := newRunID()
+	e.runs.Do(id, func() {
+		e.updateResults(id)
+	})
+}
+
+// TriggerRun starts a speedtest run in the background, returning its ID. If a
+// run is already in progress, no new run is started, and the ID of the run in
+// progress is returned instead.
+func (e *SpeedtestExporter) TriggerRun() (string, bool) {
+	id := newRunID()
+	return e.runs.Go(id, func() {
+		e.updateResults(id)
+	})
+}
+
+func (e *SpeedtestExporter) updateResults(id string) {
+	if err := e.acquireTester(e.ctx); err != nil {
+		return
+	}
+	defer e.releaseTester()
+	run := Run{ID: id, Started: time.Now()}
+	defer func() {
+		e.recordRun(run)
+	}()
+	// All of the run's traffic, including looking up the client for ISP
+	// policies, is charged to the bandwidth budget.
+	usage := &bandwidth_observer.Usage{}
+	ctx := bandwidth_observer.WithUsage(e.ctx, usage)
+	spec := e.defaultSpec()
+	defer func() {
+		e.recordUsage(usage, len(run.Results), spec)
+	}()
+	// Server discovery starts with fetching the client, which ISP policies
+	// need, so it's only fetched once per run, and timed along with the
+	// server list.
+	discovery := prometheus.NewTimer(prometheus.ObserverFunc(func(v float64) {
+		if e.getTargetDuration != nil {
+			e.getTargetDuration.Set(v)
+		}
+		e.targetUpdateTime.Observe(v)
+	}))
+	fail := func(err error) {
+		discovery.ObserveDuration()
+		run.Finished = time.Now()
+		run.Error = err.Error()
+		e.cache.SetFailed(err)
 		log.Error().Err(err).Msg("Failed to get speedtest targets")
 		e.testErrors.Inc()
+	}
+	log.Debug().Msg("Collecting Speedtest Target")
+	user, err := e.fetchClient(ctx)
+	if err != nil {
+		e.testsRun.Inc()
+		fail(err)
 		return
 	}
-	log.Debug().Interface("targets", targets).Msg("Running Speed Test")
-	err = e.RunSpeedtest(targets)
+	spec, err = e.applyISPPolicy(user, spec)
+	if err == nil {
+		spec, err = e.applyBudget(spec, e.expectedServerCount())
+	}
 	if err != nil {
-		e.cache.Set(speedtest.Servers{})
-		log.Error().Err(err).Msg("Failed to run speedtest")
-		e.testErrors.Inc()
+		run.Finished = time.Now()
+		run.Error = err.Error()
+		run.Skipped = true
+		e.lastSkip.Store(run.Finished.UnixNano())
+		return
+	}
+	e.testsRun.Inc()
+	defer func() {
+		e.runBytes.WithLabelValues("download").Set(float64(usage.Downloaded()))
+		e.runBytes.WithLabelValues("upload").Set(float64(usage.Uploaded()))
+	}()
+	targets, err := e.getServers(ctx)
+	if err != nil {
+		fail(err)
 		return
 	}
-	log.Info().Interface("results", targets).Msg("Updated Results")
-	e.cache.Set(targets)
+	discovery.ObserveDuration()
+	log.Debug().Interface("targets", targets).Msg("Running Speed Test")
+	run.Results = e.runSpeedtest(ctx, targets, spec, e.timers)
+	run.Finished = time.Now()
+	log.Info().Interface("results", run.Results).Msg("Updated Results")
+	e.cache.Set(run.Results)
 }
 
+// TestLoop runs speedtests according to the exporter's schedule until its
+// context is done.
 func (e *SpeedtestExporter) TestLoop() {
-	e.UpdateResults()
-	t := time.NewTicker(e.testInterval)
+	schedule := e.currentSettings().schedule
+	next := schedule.First(time.Now())
 	for {
+		e.nextRun.Store(next.At.UnixNano())
+		log.Debug().Time("next_run", next.At).Msg("Scheduled next speedtest run")
+		timer := time.NewTimer(time.Until(next.At))
 		select {
 		case <-e.ctx.Done():
+			timer.Stop()
 			close(e.done)
 			return
-		case <-t.C:
+		case <-e.reloaded:
+			timer.Stop()
+			if s := e.currentSettings().schedule; !s.Equal(schedule) {
+				log.Info().Stringer("schedule", s).Msg("Test schedule changed")
+				schedule = s
+				next = schedule.Next(time.Now())
+			}
+		case <-timer.C:
 			e.UpdateResults()
-			e.testsRun.Inc()
+			// Schedule the next run from when this one was due rather than
+			// when it started, so splay doesn't accumulate.
+			next = schedule.Next(next.Due)
+			// If the run overran the schedule, skip the runs it missed.
+			if now := time.Now(); next.At.Before(now) {
+				next = schedule.Next(now)
+			}
 		}
 	}
 }
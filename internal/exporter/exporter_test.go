@@ -2,15 +2,28 @@ package exporter
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"net/http/httptest"
 	"regexp"
+	"speedtest-exporter/internal/bandwidth_budget"
+	"speedtest-exporter/internal/bandwidth_observer"
+	"speedtest-exporter/internal/metric_schema"
+	"speedtest-exporter/internal/result_store"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	dto "github.com/prometheus/client_model/go"
+	"github.com/showwin/speedtest-go/speedtest"
+	"github.com/showwin/speedtest-go/speedtest/transport"
 	"github.com/stretchr/testify/require"
 	"github.com/tj/assert"
 )
@@ -61,7 +74,9 @@ func TestCollect(t *testing.T) {
 		metric := &dto.Metric{}
 		elem.Write(metric)
 
-		assert.NotEqual(0, metric.GetGauge().GetValue())
+		if metric.Gauge != nil {
+			assert.NotEqual(0, metric.GetGauge().GetValue())
+		}
 		received++
 	}
 	assert.GreaterOrEqual(received, 5)
@@ -69,22 +84,22 @@ func TestCollect(t *testing.T) {
 }
 
 /* Example Output:
-# HELP speedtest_download_speed_mbps Latency to Speedtest Server in seconds
+# HELP speedtest_download_speed_mbps Download speed from Speedtest Server in bytes per second
 # TYPE speedtest_download_speed_mbps gauge
 speedtest_download_speed_mbps{country="United States",distance="1.0",lat="1.0",lon="-1.0",name="Anytown, USA",server_id="1",sponsor="Dat Sponsor Doh",url="http://speedtest.example.net:8080/speedtest/upload.php"} 716.7810615213976
 # HELP speedtest_exporter_info Info about this speedtest-exporter
 # TYPE speedtest_exporter_info gauge
 speedtest_exporter_info{app_name="speedtest-exporter",app_version="x.x.x"} 1
-# HELP speedtest_latency_ms Latency to Speedtest Server in seconds
+# HELP speedtest_latency_ms Average latency to Speedtest Server in milliseconds
 # TYPE speedtest_latency_ms gauge
 speedtest_latency_ms{country="United States",distance="1.0",lat="1.0",lon="-1.0",name="Anytown, USA",server_id="1",sponsor="Dat Sponsor Doh",url="http://speedtest.example.net:8080/speedtest/upload.php"} 4.13
-# HELP speedtest_target_update_duration_ms Duration of speedtest runs in seconds
+# HELP speedtest_target_update_duration_ms Duration of the last speedtest server discovery in seconds
 # TYPE speedtest_target_update_duration_ms gauge
 speedtest_target_update_duration_ms 0.206249213
-# HELP speedtest_test_duration_ms Duration of speedtest runs in seconds
+# HELP speedtest_test_duration_ms Duration of the last speedtest run in seconds
 # TYPE speedtest_test_duration_ms gauge
 speedtest_test_duration_ms 6.257747472
-# HELP speedtest_upload_speed_mbps Latency to Speedtest Server in seconds
+# HELP speedtest_upload_speed_mbps Upload speed to Speedtest Server in bytes per second
 # TYPE speedtest_upload_speed_mbps gauge
 speedtest_upload_speed_mbps{country="United States",distance="1.0",lat="1.0",lon="-1.0",name="Anytown, USA",server_id="1",sponsor="Dat Sponsor Doh",url="http://speedtest.example.net:8080/speedtest/upload.php"} 724.4910836862521
 */
@@ -119,6 +134,13 @@ func TestAllMetricsPopulated(t *testing.T) {
 	}{
 		{"speed_test_download_speed_desc", regexp.MustCompile(`(?m)^# HELP speedtest_download_speed_mbps .+$`)},
 		{"speed_test_download_speed", regexp.MustCompile(`(?m)^speedtest_download_speed_mbps{country=".+",distance="[0-9\.]+",lat="[0-9\.\-]+",lon="[0-9\.\-]+",name=".+",server_id="[0-9]+",sponsor=".+",url=".+"} [0-9e+\.]+$`)},
+		{"speed_test_jitter", regexp.MustCompile(`(?m)^speedtest_jitter_ms{.+} [0-9e+\.]+$`)},
+		{"speed_test_latency_min", regexp.MustCompile(`(?m)^speedtest_latency_min_ms{.+} [0-9e+\.]+$`)},
+		{"speed_test_phase_duration", regexp.MustCompile(`(?m)^speedtest_phase_duration_seconds_count{phase="download"} 1$`)},
+		{"speed_test_target_update_duration", regexp.MustCompile(`(?m)^speedtest_target_update_duration_seconds_count 1$`)},
+		{"speed_test_latency_max", regexp.MustCompile(`(?m)^speedtest_latency_max_ms{.+} [0-9e+\.]+$`)},
+		{"speed_test_tests_run", regexp.MustCompile(`(?m)^speedtest_tests_run_total 1$`)},
+		{"speed_test_test_errors", regexp.MustCompile(`(?m)^speedtest_test_errors_total 0$`)},
 	}
 	for _, tt := range tests {
 		t.Run(tt.desc, func(t *testing.T) {
@@ -126,3 +148,548 @@ func TestAllMetricsPopulated(t *testing.T) {
 		})
 	}
 }
+
+func TestParseServerIDs(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		want    []int
+		wantErr bool
+	}{
+		{"empty", "", []int{}, false},
+		{"single", "1234", []int{1234}, false},
+		{"multiple", "1234, 5678,91011", []int{1234, 5678, 91011}, false},
+		{"trailing_comma", "1234,", []int{1234}, false},
+		{"duplicates", "1,1", nil, true},
+		{"duplicates_apart", "5678,1234,5678", nil, true},
+		{"invalid", "1234,abc", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			got, err := ParseServerIDs(tt.input)
+			if tt.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tt.want, got)
+		})
+	}
+}
+
+func TestGetServersPinned(t *testing.T) {
+	tests := []struct {
+		desc          string
+		serverIDs     []int
+		serverCount   int
+		wantIDs       []string
+		wantCount     int
+		wantFallbacks int
+	}{
+		{"closest", nil, 0, nil, 1, 0},
+		{"closest_n", nil, 2, []string{"1", "2"}, 2, 0},
+		{"closest_n_skips_unreachable", nil, 5, []string{"1", "2"}, 2, 0},
+		{"pinned", []int{1}, 0, []string{"1"}, 1, 0},
+		{"pinned_multiple", []int{2, 1}, 0, []string{"2", "1"}, 2, 0},
+		{"fallback", []int{999}, 0, nil, 1, 1},
+		{"partial_fallback", []int{2, 999}, 0, []string{"2", "1"}, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			e := New(Opts{
+				Doer:        NewTestClient(),
+				Ctx:         ctx,
+				ServerIDs:   tt.serverIDs,
+				ServerCount: tt.serverCount,
+			})
+			_, err := e.fetchClient(ctx)
+			require.NoError(err)
+			targets, err := e.getServers(ctx)
+			require.NoError(err)
+
+			ids := []string{}
+			for _, srv := range targets {
+				ids = append(ids, srv.ID)
+			}
+			assert.Len(ids, tt.wantCount)
+			if tt.wantIDs != nil {
+				assert.ElementsMatch(tt.wantIDs, ids)
+			}
+			assert.Equal(tt.wantFallbacks, testutil.CollectAndCount(e.serverFallbacks))
+		})
+	}
+}
+
+func TestRunSpeedtestPartialFailure(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer: NewTestClient(),
+		Ctx:  ctx,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+
+	serverList, err := e.speedtest.FetchServerListContext(ctx)
+	require.NoError(err)
+	require.Len(serverList, 3)
+
+	results := e.RunSpeedtest(serverList)
+	require.Len(results, 3)
+	for _, r := range results {
+		assert.Equal(r.Server.Host != unreachableHost+":8080", r.Success(), "server %s", r.Server.ID)
+		assert.False(r.Timestamp.IsZero())
+	}
+	e.cache.Set(results)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	assert.Equal(3, testutil.CollectAndCount(reg, "speedtest_server_success"))
+	assert.Equal(2, testutil.CollectAndCount(reg, "speedtest_download_speed_mbps"))
+	assert.NoError(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP speedtest_test_errors_total Number of errors during speedtest runs
+# TYPE speedtest_test_errors_total counter
+speedtest_test_errors_total 1
+`), "speedtest_test_errors_total"))
+}
+
+func TestResultCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	good := Result{Server: &speedtest.Server{ID: "1", DLSpeed: 100}, Timestamp: time.Now()}
+	failed := Result{Server: &speedtest.Server{ID: "1"}, Error: "boom", Timestamp: time.Now()}
+
+	c := NewResultCache(0)
+	assert.Empty(c.Get())
+	assert.True(c.LastAttempt().IsZero())
+
+	c.Set([]Result{good})
+	require.Len(c.Get(), 1)
+	assert.Equal(good.Server, c.Get()[0].Server)
+	assert.False(c.LastSuccess().IsZero())
+	lastSuccess := c.LastSuccess()
+
+	// a failed attempt retains the last good result
+	c.Set([]Result{failed})
+	require.Len(c.Get(), 1)
+	assert.Equal(good.Server, c.Get()[0].Server)
+	require.Len(c.Attempts(), 1)
+	assert.False(c.Attempts()[0].Success())
+	assert.Equal(lastSuccess, c.LastSuccess())
+	assert.True(c.LastAttempt().After(lastSuccess))
+
+	c.SetFailed(errors.New("no servers"))
+	assert.Len(c.Get(), 1)
+	assert.Equal("no servers", c.LastError())
+
+	// servers no longer being tested are dropped
+	c.Set([]Result{{Server: &speedtest.Server{ID: "2"}, Timestamp: time.Now()}})
+	require.Len(c.Get(), 1)
+	assert.Equal("2", c.Get()[0].Server.ID)
+}
+
+func TestResultCacheMaxAge(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewResultCache(time.Minute)
+	c.Set([]Result{
+		{Server: &speedtest.Server{ID: "1"}, Timestamp: time.Now()},
+		{Server: &speedtest.Server{ID: "2"}, Timestamp: time.Now().Add(-2 * time.Minute)},
+	})
+	results := c.Get()
+	assert.Len(results, 1)
+	assert.Equal("1", results[0].Server.ID)
+	assert.Len(c.Attempts(), 2)
+}
+
+func TestScrapeMode(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer:       NewTestClient(),
+		Ctx:        ctx,
+		TestMode:   TestModeScrape,
+		TestMinAge: time.Hour,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+
+	// concurrent scrapes share a single run
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Equal(1, testutil.CollectAndCount(e, "speedtest_download_speed_mbps"))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+
+	// results younger than the min age are served from the cache
+	assert.Equal(1, testutil.CollectAndCount(e, "speedtest_download_speed_mbps"))
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+}
+
+func TestCollectResult(t *testing.T) {
+	tests := []struct {
+		desc       string
+		packetLoss transport.PLoss
+		want       string
+	}{
+		{"no_packet_loss_measured", transport.PLoss{}, ""},
+		{"packet_loss", transport.PLoss{Sent: 75, Dup: 0, Max: 99}, `
+# HELP speedtest_packet_loss_ratio Ratio of packets lost to Speedtest Server, from 0 to 1
+# TYPE speedtest_packet_loss_ratio gauge
+speedtest_packet_loss_ratio{country="US",distance="1.500000",lat="1.0",lon="-1.0",name="Anytown",server_id="1",sponsor="Sponsor",url="http://speedtest.example.net"} 0.25
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			c := resultCollector{newResultMetrics(metric_schema.V1, nil), []Result{{
+				Server: &speedtest.Server{
+					ID:         "1",
+					URL:        "http://speedtest.example.net",
+					Name:       "Anytown",
+					Country:    "US",
+					Sponsor:    "Sponsor",
+					Lat:        "1.0",
+					Lon:        "-1.0",
+					Distance:   1.5,
+					Latency:    10 * time.Millisecond,
+					Jitter:     2 * time.Millisecond,
+					MinLatency: 8 * time.Millisecond,
+					MaxLatency: 15 * time.Millisecond,
+					PacketLoss: tt.packetLoss,
+				},
+			}}}
+			assert.NoError(testutil.CollectAndCompare(c, strings.NewReader(tt.want), "speedtest_packet_loss_ratio"))
+			assert.NoError(testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP speedtest_jitter_ms Jitter (standard deviation of latency) to Speedtest Server in milliseconds
+# TYPE speedtest_jitter_ms gauge
+speedtest_jitter_ms{country="US",distance="1.500000",lat="1.0",lon="-1.0",name="Anytown",server_id="1",sponsor="Sponsor",url="http://speedtest.example.net"} 2
+`), "speedtest_jitter_ms"))
+		})
+	}
+}
+
+func TestMetricSchemaV2(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	e := New(Opts{MetricSchema: metric_schema.V2})
+	e.cache.Set([]Result{{
+		Server: &speedtest.Server{
+			ID:         "1",
+			URL:        "http://speedtest.example.net",
+			Name:       "Anytown",
+			Country:    "US",
+			Sponsor:    "Sponsor",
+			Lat:        "1.0",
+			Lon:        "-1.0",
+			Distance:   1.5,
+			Latency:    10 * time.Millisecond,
+			Jitter:     2 * time.Millisecond,
+			MinLatency: 8 * time.Millisecond,
+			MaxLatency: 15 * time.Millisecond,
+			DLSpeed:    125000,
+			ULSpeed:    62500,
+		},
+		Timestamp: time.Now(),
+		PingMode:  PingModeICMP,
+	}})
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(reg.Register(e))
+
+	// v2 metrics only identify servers by ID by default
+	labels := `server_id="1"`
+	assert.NoError(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP speedtest_latency_seconds Average latency to Speedtest Server in seconds
+# TYPE speedtest_latency_seconds gauge
+speedtest_latency_seconds{ping_mode="icmp",`+labels+`} 0.01
+# HELP speedtest_download_bits_per_second Download speed from Speedtest Server in bits per second
+# TYPE speedtest_download_bits_per_second gauge
+speedtest_download_bits_per_second{`+labels+`} 1e+06
+# HELP speedtest_upload_bits_per_second Upload speed to Speedtest Server in bits per second
+# TYPE speedtest_upload_bits_per_second gauge
+speedtest_upload_bits_per_second{`+labels+`} 500000
+`), "speedtest_latency_seconds", "speedtest_download_bits_per_second", "speedtest_upload_bits_per_second"))
+
+	assert.Equal(1, testutil.CollectAndCount(e, "speedtest_test_duration_seconds"))
+	assert.Equal(0, testutil.CollectAndCount(e, "speedtest_test_duration_ms"))
+	assert.Equal(0, testutil.CollectAndCount(e, "speedtest_target_update_duration_ms"))
+	assert.Equal(0, testutil.CollectAndCount(e, "speedtest_latency_ms"))
+}
+
+func TestRunHistory(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := result_store.NewMemoryStore(result_store.Retention{})
+	e := New(Opts{
+		Doer:  NewTestClient(),
+		Ctx:   ctx,
+		Store: store,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	e.UpdateResults()
+
+	records, err := store.List(0)
+	require.NoError(err)
+	require.Len(records, 1)
+	var run Run
+	require.NoError(json.Unmarshal(records[0].Data, &run))
+	assert.Equal(records[0].ID, run.ID)
+	require.Len(run.Results, 1)
+	assert.True(run.Results[0].Success())
+	assert.False(run.Finished.Before(run.Started))
+
+	// a new exporter restores the last results from the store
+	restored := New(Opts{
+		Doer:  NewTestClient(),
+		Ctx:   ctx,
+		Store: store,
+	})
+	require.Len(restored.cache.Get(), 1)
+	assert.Equal(run.Results[0].Server.ID, restored.cache.Get()[0].Server.ID)
+	assert.Equal(run.Finished.Unix(), restored.cache.LastSuccess().Unix())
+	assert.Equal(1, testutil.CollectAndCount(restored, "speedtest_download_speed_mbps"))
+}
+
+func TestBandwidthBudget(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	budget, err := bandwidth_budget.New(bandwidth_budget.Opts{Limit: 1})
+	require.NoError(err)
+	store := result_store.NewMemoryStore(result_store.Retention{})
+	bw := bandwidth_observer.New(bandwidth_observer.Opts{Transport: roundTripFunc(speedtestFunc)})
+	e := New(Opts{
+		Doer:   &http.Client{Transport: bw},
+		Ctx:    ctx,
+		Store:  store,
+		Budget: budget,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	e.UpdateResults()
+	require.Len(e.cache.Get(), 1)
+	// the first run overruns the budget
+	assert.Less(budget.Remaining(), int64(0))
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+	lastAttempt := e.cache.LastAttempt()
+
+	// so the next is skipped, leaving the cached results alone
+	e.UpdateResults()
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+	assert.Equal(1.0, testutil.ToFloat64(e.budgetSkips))
+	assert.Equal(lastAttempt, e.cache.LastAttempt())
+	assert.Len(e.cache.Get(), 1)
+	records, err := store.List(1)
+	require.NoError(err)
+	var run Run
+	require.NoError(json.Unmarshal(records[0].Data, &run))
+	assert.Equal(ErrBudgetExhausted.Error(), run.Error)
+	assert.True(run.Skipped)
+
+	// and after a restart, the skipped run isn't mistaken for a failure
+	restored := New(Opts{Ctx: ctx, Store: store})
+	assert.Empty(restored.cache.LastError())
+	assert.True(restored.cache.LastAttempt().Before(run.Finished))
+	assert.Len(restored.cache.Get(), 1)
+
+	assert.Equal(1, testutil.CollectAndCount(e, "speedtest_bandwidth_budget_remaining_bytes"))
+	assert.Equal(1, testutil.CollectAndCount(e, "speedtest_bandwidth_budget_skipped_runs_total"))
+	// without a budget, neither is exported
+	assert.Equal(0, testutil.CollectAndCount(New(Opts{}), "speedtest_bandwidth_budget_remaining_bytes"))
+}
+
+func TestBandwidthBudgetUsage(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const limit = 1 << 30
+	budget, err := bandwidth_budget.New(bandwidth_budget.Opts{Limit: limit})
+	require.NoError(err)
+	bw := bandwidth_observer.New(bandwidth_observer.Opts{Transport: roundTripFunc(speedtestFunc)})
+	e := New(Opts{
+		Doer:   &http.Client{Transport: bw},
+		Ctx:    ctx,
+		Budget: budget,
+		// without download or upload tests, all of the run's traffic is
+		// server discovery and pings
+		Phases: TestPhases{PhasePing},
+	})
+	e.UpdateResults()
+	results := e.cache.Get()
+	require.Len(results, 1)
+	assert.Zero(results[0].BytesDownloaded + results[0].BytesUploaded)
+
+	used := testutil.ToFloat64(e.runBytes.WithLabelValues("download")) + testutil.ToFloat64(e.runBytes.WithLabelValues("upload"))
+	assert.Greater(used, 0.0)
+	assert.NoError(testutil.CollectAndCompare(e, strings.NewReader(fmt.Sprintf(`
+# HELP speedtest_bandwidth_budget_remaining_bytes Bytes left in the bandwidth budget for the current period
+# TYPE speedtest_bandwidth_budget_remaining_bytes gauge
+speedtest_bandwidth_budget_remaining_bytes %d
+`, limit-int64(used))), "speedtest_bandwidth_budget_remaining_bytes"))
+}
+
+func TestBandwidthAttribution(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// bytes are attributed to phases and servers in the default schema
+	bw := bandwidth_observer.New(bandwidth_observer.Opts{Transport: roundTripFunc(speedtestFunc)})
+	e := New(Opts{
+		Doer: &http.Client{Transport: bw},
+		Ctx:  ctx,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	e.UpdateResults()
+	results := e.cache.Get()
+	require.Len(results, 1)
+	serverID := results[0].Server.ID
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(bw)
+	families, err := reg.Gather()
+	require.NoError(err)
+	// bytes by direction, then phase and server ID
+	bytes := map[string]map[[2]string]float64{}
+	for _, family := range families {
+		if family.GetName() != "speedtest_phase_bytes_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, pair := range metric.GetLabel() {
+				labels[pair.GetName()] = pair.GetValue()
+			}
+			if bytes[labels["direction"]] == nil {
+				bytes[labels["direction"]] = map[[2]string]float64{}
+			}
+			bytes[labels["direction"]][[2]string{labels["phase"], labels["server_id"]}] += metric.GetCounter().GetValue()
+		}
+	}
+	downloaded := bytes["download"]
+	uploaded := bytes["upload"]
+	// server discovery isn't attributed to any server
+	assert.Greater(downloaded[[2]string{PhaseConfig, ""}], 0.0)
+	assert.Greater(downloaded[[2]string{PhaseServerList, ""}], 0.0)
+	assert.Greater(uploaded[[2]string{PhaseUpload, serverID}], 0.0)
+	assert.Zero(uploaded[[2]string{PhaseDownload, serverID}])
+
+	// speedtest-go pings each server in the list without the run's context,
+	// so that traffic is untagged, and not part of the run's bytes.
+	assert.Greater(downloaded[[2]string{"", ""}], 0.0)
+	var totalDownloaded, totalUploaded float64
+	for tags, v := range downloaded {
+		if tags[0] != "" {
+			totalDownloaded += v
+		}
+	}
+	for tags, v := range uploaded {
+		if tags[0] != "" {
+			totalUploaded += v
+		}
+	}
+	assert.Equal(totalDownloaded, testutil.ToFloat64(e.runBytes.WithLabelValues("download")))
+	assert.Equal(totalUploaded, testutil.ToFloat64(e.runBytes.WithLabelValues("upload")))
+}
+
+func TestPingRTT(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer:      NewTestClient(),
+		Ctx:       ctx,
+		ServerIDs: []int{1},
+		PingCount: 3,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	e.UpdateResults()
+	e.UpdateResults()
+
+	reg := prometheus.NewPedanticRegistry()
+	require.NoError(reg.Register(e))
+	families, err := reg.Gather()
+	require.NoError(err)
+	var rtt *dto.MetricFamily
+	for _, family := range families {
+		if family.GetName() == "speedtest_ping_rtt_seconds" {
+			rtt = family
+		}
+	}
+	require.NotNil(rtt)
+	require.Len(rtt.GetMetric(), 1)
+	metric := rtt.GetMetric()[0]
+	labels := map[string]string{}
+	for _, label := range metric.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	assert.Equal(map[string]string{"server_id": "1", "ping_mode": "http"}, labels)
+	// every sample from both runs is observed
+	assert.Equal(uint64(6), metric.GetHistogram().GetSampleCount())
+	assert.Greater(metric.GetHistogram().GetSampleSum(), 0.0)
+}
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer:         NewTestClient(),
+		Ctx:          ctx,
+		TestInterval: time.Hour,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	// the next run is only exported once TestLoop schedules one
+	assert.Equal(0, testutil.CollectAndCount(e, "speedtest_next_run_timestamp_seconds"))
+	go e.TestLoop()
+	assert.Eventually(func() bool {
+		return len(e.cache.Get()) == 1
+	}, 15*time.Second, 100*time.Millisecond)
+	assert.Eventually(func() bool {
+		return e.nextRun.Load() > time.Now().Add(50*time.Minute).Unix()
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Equal(1, testutil.CollectAndCount(e, "speedtest_next_run_timestamp_seconds"))
+
+	e.Reload(Opts{
+		TestInterval: 100 * time.Millisecond,
+		ServerIDs:    []int{2},
+		SavingMode:   true,
+	})
+	settings := e.currentSettings()
+	assert.Equal([]int{2}, settings.serverIDs)
+	assert.True(settings.savingMode)
+	// unset options fall back to their defaults
+	assert.Equal(time.Minute, settings.testTimeout)
+
+	// cached results survive the reload, and TestLoop picks up the new
+	// interval
+	assert.Len(e.cache.Get(), 1)
+	assert.Eventually(func() bool {
+		results := e.cache.Get()
+		return testutil.ToFloat64(e.testsRun) >= 2 && len(results) == 1 && results[0].Server.ID == "2"
+	}, 20*time.Second, 100*time.Millisecond)
+	cancel()
+	<-e.done
+}
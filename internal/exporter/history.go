@@ -0,0 +1,74 @@
+package exporter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"speedtest-exporter/internal/result_store"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Run is the outcome of a single speedtest run across all of its targets.
+type Run struct {
+	ID       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	// Error is set if the run failed before any server could be tested.
+	Error string `json:"error,omitempty"`
+	// Skipped is set if the run was skipped by the bandwidth budget or an
+	// ISP policy, in which case Error says why. Skipped runs leave the result
+	// cache alone.
+	Skipped bool     `json:"skipped,omitempty"`
+	Results []Result `json:"results"`
+}
+
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// recordRun appends run to the exporter's store, if it has one.
+func (e *SpeedtestExporter) recordRun(run Run) {
+	if e.store == nil {
+		return
+	}
+	data, err := json.Marshal(run)
+	if err != nil {
+		log.Error().Err(err).Str("run_id", run.ID).Msg("Failed to encode speedtest run")
+		return
+	}
+	err = e.store.Append(result_store.Record{
+		ID:        run.ID,
+		Timestamp: run.Finished,
+		Data:      data,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("run_id", run.ID).Msg("Failed to record speedtest run")
+	}
+}
+
+// restoreRuns replays the runs in the exporter's store into the result cache,
+// so results are available immediately after a restart.
+func (e *SpeedtestExporter) restoreRuns() {
+	if e.store == nil {
+		return
+	}
+	records, err := e.store.List(0)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to load speedtest history")
+		return
+	}
+	// records are newest first
+	for i := len(records) - 1; i >= 0; i-- {
+		var run Run
+		if err := json.Unmarshal(records[i].Data, &run); err != nil {
+			log.Warn().Err(err).Str("run_id", records[i].ID).Msg("Skipping undecodable speedtest run")
+			continue
+		}
+		e.cache.Restore(run)
+	}
+	log.Info().Int("runs", len(records)).Msg("Restored speedtest history")
+}
@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// ISPPolicy is how speedtests are run while the client's ISP matches an
+// ISPRule, e.g. to save bandwidth on a metered backup link.
+type ISPPolicy string
+
+const (
+	// ISPPolicySaving runs speedtests in saving mode.
+	ISPPolicySaving ISPPolicy = "saving"
+	// ISPPolicyPingOnly only measures latency, skipping the download and
+	// upload tests.
+	ISPPolicyPingOnly ISPPolicy = "ping_only"
+	// ISPPolicyInterval runs speedtests at most once per the rule's interval.
+	ISPPolicyInterval ISPPolicy = "interval"
+)
+
+// ispPolicyNone is the policy exported when no rule matches the client's ISP.
+const ispPolicyNone = "none"
+
+// ParseISPPolicy parses an ISPPolicy from its string representation.
+func ParseISPPolicy(s string) (ISPPolicy, error) {
+	switch policy := ISPPolicy(s); policy {
+	case ISPPolicySaving, ISPPolicyPingOnly, ISPPolicyInterval:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown ISP policy %q", s)
+}
+
+func (p ISPPolicy) MarshalText() ([]byte, error) {
+	return []byte(p), nil
+}
+
+func (p *ISPPolicy) UnmarshalText(text []byte) error {
+	policy, err := ParseISPPolicy(string(text))
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+// ISPRule applies Policy while the client's ISP, as reported by speedtest.net,
+// matches ISP.
+type ISPRule struct {
+	ISP    *regexp.Regexp
+	Policy ISPPolicy
+	// Interval is, for ISPPolicyInterval, the minimum time between runs.
+	Interval time.Duration
+}
+
+// ErrISPPolicyDeferred is the error of a run skipped because the client's ISP
+// matched an interval rule, and the last run was too recent.
+var ErrISPPolicyDeferred = errors.New("skipped by ISP policy, the last run was too recent")
+
+var isp_policy = prometheus.NewDesc(
+	prometheus.BuildFQName("speedtest", "", "isp_policy"),
+	"The ISP policy in effect for the client's ISP from the last server discovery, and the pattern of the rule which matched it",
+	[]string{"policy", "rule"},
+	nil,
+)
+
+// matchISPRule returns the first of rules which matches isp, or nil if none
+// do.
+func matchISPRule(rules []ISPRule, isp string) *ISPRule {
+	for i := range rules {
+		if rules[i].ISP.MatchString(isp) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// applyISPPolicy adjusts spec according to the rule matching the ISP of user,
+// the client as fetched at the start of the run, if any, returning
+// ErrISPPolicyDeferred if the run should be skipped.
+func (e *SpeedtestExporter) applyISPPolicy(user *speedtest.User, spec testSpec) (testSpec, error) {
+	rules := e.currentSettings().ispRules
+	if len(rules) == 0 {
+		return spec, nil
+	}
+	rule := matchISPRule(rules, user.Isp)
+	if rule == nil {
+		return spec, nil
+	}
+	switch rule.Policy {
+	case ISPPolicySaving:
+		spec.savingMode = true
+	case ISPPolicyPingOnly:
+		spec.phases = TestPhases{PhasePing}
+	case ISPPolicyInterval:
+		if last := e.cache.LastAttempt(); !last.IsZero() && time.Since(last) < rule.Interval {
+			log.Info().
+				Str("isp", user.Isp).
+				Stringer("rule", rule.ISP).
+				Time("last_attempt", last).
+				Msg("Skipping speedtest run on ISP policy interval")
+			e.ispPolicySkips.Inc()
+			return spec, ErrISPPolicyDeferred
+		}
+	}
+	log.Info().
+		Str("isp", user.Isp).
+		Stringer("rule", rule.ISP).
+		Str("policy", string(rule.Policy)).
+		Msg("Applying ISP policy")
+	return spec, nil
+}
+
+func (e *SpeedtestExporter) collectISPPolicy(ch chan<- prometheus.Metric, rules []ISPRule) {
+	user := e.client.Load()
+	if user == nil {
+		return
+	}
+	policy, pattern := ispPolicyNone, ""
+	if rule := matchISPRule(rules, user.Isp); rule != nil {
+		policy, pattern = string(rule.Policy), rule.ISP.String()
+	}
+	ch <- prometheus.MustNewConstMetric(isp_policy, prometheus.GaugeValue, 1, policy, pattern)
+}
@@ -0,0 +1,166 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"speedtest-exporter/internal/result_store"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func TestParseISPPolicy(t *testing.T) {
+	for _, s := range []string{"saving", "ping_only", "interval"} {
+		policy, err := ParseISPPolicy(s)
+		assert.NoError(t, err)
+		assert.Equal(t, ISPPolicy(s), policy)
+	}
+	_, err := ParseISPPolicy("off")
+	assert.Error(t, err)
+}
+
+func TestMatchISPRule(t *testing.T) {
+	rules := []ISPRule{
+		{ISP: regexp.MustCompile(`(?i)\blte\b`), Policy: ISPPolicyPingOnly},
+		{ISP: regexp.MustCompile(`Mobile`), Policy: ISPPolicySaving},
+		{ISP: regexp.MustCompile(`Mobile LTE`), Policy: ISPPolicyInterval},
+	}
+	tests := []struct {
+		isp  string
+		want *ISPRule
+	}{
+		{"Fibre Co", nil},
+		{"Example LTE", &rules[0]},
+		{"Example Mobile", &rules[1]},
+		// the first matching rule applies
+		{"Example Mobile LTE", &rules[0]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.isp, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchISPRule(rules, tt.isp))
+		})
+	}
+}
+
+func TestISPPolicy(t *testing.T) {
+	// the mock client's ISP is "Dat Sponsor Doh"
+	tests := []struct {
+		desc       string
+		rule       ISPRule
+		wantSaving bool
+		wantPhases TestPhases
+		want       string
+	}{
+		{"no_match", ISPRule{ISP: regexp.MustCompile("LTE"), Policy: ISPPolicySaving}, false, nil, `policy="none",rule=""`},
+		{"saving", ISPRule{ISP: regexp.MustCompile("Sponsor"), Policy: ISPPolicySaving}, true, nil, `policy="saving",rule="Sponsor"`},
+		{"ping_only", ISPRule{ISP: regexp.MustCompile("Sponsor"), Policy: ISPPolicyPingOnly}, false, TestPhases{PhasePing}, `policy="ping_only",rule="Sponsor"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			e := New(Opts{
+				Doer:     NewTestClient(),
+				Ctx:      ctx,
+				ISPRules: []ISPRule{tt.rule},
+			})
+			user, err := e.fetchClient(ctx)
+			require.NoError(t, err)
+			spec, err := e.applyISPPolicy(user, e.defaultSpec())
+			assert.NoError(err)
+			assert.Equal(tt.wantSaving, spec.savingMode)
+			assert.Equal(tt.wantPhases, spec.phases)
+			assert.NoError(testutil.CollectAndCompare(e, strings.NewReader(`
+# HELP speedtest_isp_policy The ISP policy in effect for the client's ISP from the last server discovery, and the pattern of the rule which matched it
+# TYPE speedtest_isp_policy gauge
+speedtest_isp_policy{`+tt.want+`} 1
+`), "speedtest_isp_policy"))
+		})
+	}
+}
+
+func TestISPPolicyPingOnly(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer:     NewTestClient(),
+		Ctx:      ctx,
+		ISPRules: []ISPRule{{ISP: regexp.MustCompile("Sponsor"), Policy: ISPPolicyPingOnly}},
+	})
+	e.UpdateResults()
+	results := e.cache.Get()
+	require.Len(results, 1)
+	assert.Equal(TestPhases{PhasePing}, results[0].Phases)
+	assert.Equal(1, testutil.CollectAndCount(e, "speedtest_latency_ms"))
+	assert.Equal(0, testutil.CollectAndCount(e, "speedtest_download_speed_mbps"))
+	assert.Equal(0, testutil.CollectAndCount(e, "speedtest_upload_speed_mbps"))
+}
+
+func TestISPPolicyInterval(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	store := result_store.NewMemoryStore(result_store.Retention{})
+	e := New(Opts{
+		Doer:  NewTestClient(),
+		Ctx:   ctx,
+		Store: store,
+		ISPRules: []ISPRule{
+			{ISP: regexp.MustCompile("Sponsor"), Policy: ISPPolicyInterval, Interval: time.Hour},
+		},
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	// nothing has run yet, so the first run goes ahead
+	e.UpdateResults()
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+	lastAttempt := e.cache.LastAttempt()
+
+	// but the next is deferred until the interval has passed
+	e.UpdateResults()
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+	assert.Equal(1.0, testutil.ToFloat64(e.ispPolicySkips))
+	assert.Equal(lastAttempt, e.cache.LastAttempt())
+	records, err := store.List(1)
+	require.NoError(t, err)
+	var run Run
+	require.NoError(t, json.Unmarshal(records[0].Data, &run))
+	assert.Equal(ErrISPPolicyDeferred.Error(), run.Error)
+	assert.True(run.Skipped)
+}
+
+func TestISPPolicyIntervalScrape(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer:       NewTestClient(),
+		Ctx:        ctx,
+		TestMode:   TestModeScrape,
+		TestMinAge: 50 * time.Millisecond,
+		ISPRules: []ISPRule{
+			{ISP: regexp.MustCompile("Sponsor"), Policy: ISPPolicyInterval, Interval: time.Hour},
+		},
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+	testutil.CollectAndCount(e)
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+
+	// once the min age has passed, the next scrape looks up the client, and
+	// the run is deferred
+	time.Sleep(100 * time.Millisecond)
+	testutil.CollectAndCount(e)
+	assert.Equal(1.0, testutil.ToFloat64(e.ispPolicySkips))
+
+	// but scrapes within the min age of the deferral don't look it up again
+	testutil.CollectAndCount(e)
+	assert.Equal(1.0, testutil.ToFloat64(e.ispPolicySkips))
+	assert.Equal(1.0, testutil.ToFloat64(e.testsRun))
+}
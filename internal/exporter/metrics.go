@@ -0,0 +1,222 @@
+package exporter
+
+import (
+	"context"
+	"slices"
+	"speedtest-exporter/internal/bandwidth_observer"
+	"speedtest-exporter/internal/metric_schema"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// resultMetrics describes the per-server speedtest_* metrics in a given
+// metric schema.
+type resultMetrics struct {
+	// labels identify servers on each metric.
+	labels []string
+	// pingModeLabel adds a ping_mode label to the latency metrics, in v2.
+	pingModeLabel bool
+
+	success    *prometheus.Desc
+	latency    *prometheus.Desc
+	jitter     *prometheus.Desc
+	latencyMin *prometheus.Desc
+	latencyMax *prometheus.Desc
+	dlSpeed    *prometheus.Desc
+	ulSpeed    *prometheus.Desc
+	packetLoss *prometheus.Desc
+
+	// duration converts latencies to the schema's unit.
+	duration func(time.Duration) float64
+	// rate converts transfer speeds to the schema's unit.
+	rate func(speedtest.ByteRate) float64
+}
+
+func newResultMetrics(schema metric_schema.Schema, labels []string) *resultMetrics {
+	if len(labels) == 0 {
+		labels = DefaultServerLabels(schema)
+	}
+	m := &resultMetrics{labels: labels, pingModeLabel: schema == metric_schema.V2}
+	m.success = m.newServerDesc("server_success", "Whether the last speedtest run against this server succeeded")
+	m.packetLoss = m.newServerDesc("packet_loss_ratio", "Ratio of packets lost to Speedtest Server, from 0 to 1")
+	if schema == metric_schema.V2 {
+		m.latency = m.newLatencyDesc("latency_seconds", "Average latency to Speedtest Server in seconds")
+		m.jitter = m.newLatencyDesc("jitter_seconds", "Jitter (standard deviation of latency) to Speedtest Server in seconds")
+		m.latencyMin = m.newLatencyDesc("latency_min_seconds", "Minimum latency to Speedtest Server in seconds")
+		m.latencyMax = m.newLatencyDesc("latency_max_seconds", "Maximum latency to Speedtest Server in seconds")
+		m.dlSpeed = m.newServerDesc("download_bits_per_second", "Download speed from Speedtest Server in bits per second")
+		m.ulSpeed = m.newServerDesc("upload_bits_per_second", "Upload speed to Speedtest Server in bits per second")
+		m.duration = time.Duration.Seconds
+		m.rate = func(r speedtest.ByteRate) float64 {
+			return float64(r) * 8
+		}
+		return m
+	}
+	m.latency = m.newLatencyDesc("latency_ms", "Average latency to Speedtest Server in milliseconds")
+	m.jitter = m.newLatencyDesc("jitter_ms", "Jitter (standard deviation of latency) to Speedtest Server in milliseconds")
+	m.latencyMin = m.newLatencyDesc("latency_min_ms", "Minimum latency to Speedtest Server in milliseconds")
+	m.latencyMax = m.newLatencyDesc("latency_max_ms", "Maximum latency to Speedtest Server in milliseconds")
+	m.dlSpeed = m.newServerDesc("download_speed_mbps", "Download speed from Speedtest Server in bytes per second")
+	m.ulSpeed = m.newServerDesc("upload_speed_mbps", "Upload speed to Speedtest Server in bytes per second")
+	m.duration = func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+	m.rate = func(r speedtest.ByteRate) float64 {
+		return float64(r)
+	}
+	return m
+}
+
+func (m *resultMetrics) newServerDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", name),
+		help,
+		m.labels,
+		nil,
+	)
+}
+
+// newLatencyDesc is newServerDesc, with a ping_mode label for how the
+// latency was measured if the schema has one.
+func (m *resultMetrics) newLatencyDesc(name, help string) *prometheus.Desc {
+	if !m.pingModeLabel {
+		return m.newServerDesc(name, help)
+	}
+	return prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", name),
+		help,
+		append(slices.Clone(m.labels), "ping_mode"),
+		nil,
+	)
+}
+
+// labelValues returns the values of the metrics' server labels for s.
+func (m *resultMetrics) labelValues(s *speedtest.Server) []string {
+	values := make([]string, 0, len(m.labels))
+	for _, label := range m.labels {
+		values = append(values, serverLabelValue(s, label))
+	}
+	return values
+}
+
+func (m *resultMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.success
+	ch <- m.latency
+	ch <- m.jitter
+	ch <- m.latencyMin
+	ch <- m.latencyMax
+	ch <- m.dlSpeed
+	ch <- m.ulSpeed
+	ch <- m.packetLoss
+}
+
+// collect emits the speedtest_* metrics for a successful result, omitting
+// those of phases which weren't run.
+func (m *resultMetrics) collect(ch chan<- prometheus.Metric, r Result) {
+	s := r.Server
+	labels := m.labelValues(s)
+	latencyLabels := labels
+	if m.pingModeLabel {
+		latencyLabels = append(m.labelValues(s), string(r.pingMode()))
+	}
+	if r.Phases.Has(PhasePing) {
+		ch <- prometheus.MustNewConstMetric(m.latency, prometheus.GaugeValue, m.duration(s.Latency), latencyLabels...)
+		ch <- prometheus.MustNewConstMetric(m.jitter, prometheus.GaugeValue, m.duration(s.Jitter), latencyLabels...)
+		ch <- prometheus.MustNewConstMetric(m.latencyMin, prometheus.GaugeValue, m.duration(s.MinLatency), latencyLabels...)
+		ch <- prometheus.MustNewConstMetric(m.latencyMax, prometheus.GaugeValue, m.duration(s.MaxLatency), latencyLabels...)
+	}
+	if r.Phases.Has(PhaseDownload) {
+		ch <- prometheus.MustNewConstMetric(m.dlSpeed, prometheus.GaugeValue, m.rate(s.DLSpeed), labels...)
+	}
+	if r.Phases.Has(PhaseUpload) {
+		ch <- prometheus.MustNewConstMetric(m.ulSpeed, prometheus.GaugeValue, m.rate(s.ULSpeed), labels...)
+	}
+	// speedtest-go reports a loss of -1 when packet loss wasn't measured.
+	if loss := s.PacketLoss.Loss(); loss >= 0 {
+		ch <- prometheus.MustNewConstMetric(m.packetLoss, prometheus.GaugeValue, loss, labels...)
+	}
+}
+
+// resultCollector exports the speedtest_* metrics for a fixed set of results.
+type resultCollector struct {
+	metrics *resultMetrics
+	results []Result
+}
+
+func (c resultCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.metrics.Describe(ch)
+	ch <- server_info
+	ch <- server_distance
+}
+
+func (c resultCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, r := range c.results {
+		collectServerInfo(ch, r.Server)
+		if r.Success() {
+			c.metrics.collect(ch, r)
+		}
+	}
+}
+
+// runTimers record the durations of speedtest runs.
+type runTimers struct {
+	testDuration  prometheus.Gauge
+	phaseDuration *prometheus.HistogramVec
+	pingRTT       *prometheus.HistogramVec
+}
+
+func newRunTimers(schema metric_schema.Schema) *runTimers {
+	t := &runTimers{
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "speedtest_phase_duration_seconds",
+			Help:    "Duration of each phase of speedtest runs in seconds",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 9),
+		}, []string{"phase"}),
+		pingRTT: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "speedtest_ping_rtt_seconds",
+			Help: "Round trip time of each ping to Speedtest Servers in seconds",
+			// from 1ms to ~4s
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 13),
+			// Native histograms give high resolution percentiles and heatmaps
+			// to scrapers which support them.
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  100,
+			NativeHistogramMinResetDuration: 1 * time.Hour,
+		}, []string{"server_id", "ping_mode"}),
+	}
+	if schema == metric_schema.V2 {
+		t.testDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "speedtest_test_duration_seconds",
+			Help: "Duration of the last speedtest run in seconds",
+		})
+	} else {
+		// v1 names this in milliseconds, but it's always been set in seconds.
+		t.testDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "speedtest_test_duration_ms",
+			Help: "Duration of the last speedtest run in seconds",
+		})
+	}
+	return t
+}
+
+func (t *runTimers) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.testDuration.Desc()
+	t.phaseDuration.Describe(ch)
+	t.pingRTT.Describe(ch)
+}
+
+func (t *runTimers) Collect(ch chan<- prometheus.Metric) {
+	ch <- t.testDuration
+	t.phaseDuration.Collect(ch)
+	t.pingRTT.Collect(ch)
+}
+
+// timePhase runs fn with a context whose requests are tagged with the given
+// phase, recording its duration as that phase.
+func (t *runTimers) timePhase(ctx context.Context, phase string, fn func(context.Context) error) error {
+	timer := prometheus.NewTimer(t.phaseDuration.WithLabelValues(phase))
+	defer timer.ObserveDuration()
+	return fn(bandwidth_observer.WithPhase(ctx, phase))
+}
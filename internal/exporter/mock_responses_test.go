@@ -2,6 +2,7 @@ package exporter
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"net/http"
 	"os"
@@ -12,8 +13,14 @@ import (
 // RoundTripFunc .
 type roundTripFunc func(req *http.Request) *http.Response
 
+// unreachableHost is a speedtest server host which always fails to connect.
+const unreachableHost = "unreachable.example.net"
+
 // RoundTrip .
 func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Hostname() == unreachableHost {
+		return nil, errors.New("connection refused")
+	}
 	return f(req), nil
 }
 
@@ -46,6 +53,10 @@ func speedtestFunc(req *http.Request) *http.Response {
 			ContentLength: 100,
 		}
 	case "/speedtest/upload.php":
+		// Like a real server, consume the upload.
+		if req.Body != nil {
+			_, _ = io.Copy(io.Discard, req.Body)
+		}
 		ret = &http.Response{
 			StatusCode: 200,
 			// Send response to be tested
@@ -133,6 +144,36 @@ var (
     "https_functional": 1,
     "host": "speedtest1.example.net:8080",
     "force_ping_select": 1
+  },
+  {
+    "url": "http://speedtest2.example.net:8080/speedtest/upload.php",
+    "lat": "2.00",
+    "lon": "-2.0",
+    "distance": 10,
+    "name": "Othertown, USA",
+    "country": "United States",
+    "cc": "US",
+    "sponsor": "Dat Other Sponsor",
+    "id": "2",
+    "preferred": 0,
+    "https_functional": 1,
+    "host": "speedtest2.example.net:8080",
+    "force_ping_select": 1
+  },
+  {
+    "url": "http://unreachable.example.net:8080/speedtest/upload.php",
+    "lat": "3.00",
+    "lon": "-3.0",
+    "distance": 15,
+    "name": "Nowhere, USA",
+    "country": "United States",
+    "cc": "US",
+    "sponsor": "Dat Broken Sponsor",
+    "id": "3",
+    "preferred": 0,
+    "https_functional": 1,
+    "host": "unreachable.example.net:8080",
+    "force_ping_select": 1
   }
 ]`
 )
@@ -0,0 +1,74 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// selectablePhases are the phases of a speedtest which can be selected, in
+// the order they're run. Packet loss is enabled by its duration instead.
+var selectablePhases = []string{PhasePing, PhaseDownload, PhaseUpload}
+
+// TestPhases selects which phases of a speedtest are run. Empty selects every
+// phase.
+type TestPhases []string
+
+// ParseTestPhases parses a comma separated list of test phases.
+func ParseTestPhases(s string) (TestPhases, error) {
+	phases := TestPhases{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" || slices.Contains(phases, field) {
+			continue
+		}
+		phases = append(phases, field)
+	}
+	if len(phases) == 0 {
+		return nil, errors.New("at least one test phase must be selected")
+	}
+	if err := phases.Validate(); err != nil {
+		return nil, err
+	}
+	return phases, nil
+}
+
+// Validate checks that each of p is a selectable phase.
+func (p TestPhases) Validate() error {
+	for _, phase := range p {
+		if !slices.Contains(selectablePhases, phase) {
+			return fmt.Errorf("unknown test phase %q, must be one of %s", phase, strings.Join(selectablePhases, ", "))
+		}
+	}
+	return nil
+}
+
+// Has returns whether phase is selected.
+func (p TestPhases) Has(phase string) bool {
+	return len(p) == 0 || slices.Contains(p, phase)
+}
+
+// normalize returns nil if p selects every phase, so runs which test every
+// phase record their results as runs did before phases could be selected.
+func (p TestPhases) normalize() TestPhases {
+	for _, phase := range selectablePhases {
+		if !p.Has(phase) {
+			return p
+		}
+	}
+	return nil
+}
+
+// full returns whether both throughput tests are selected, so the run's
+// bandwidth is representative of a full run.
+func (p TestPhases) full() bool {
+	return p.Has(PhaseDownload) && p.Has(PhaseUpload)
+}
+
+func (p TestPhases) String() string {
+	if len(p) == 0 {
+		return strings.Join(selectablePhases, ",")
+	}
+	return strings.Join(p, ",")
+}
@@ -0,0 +1,58 @@
+package exporter
+
+import (
+	"testing"
+
+	"github.com/tj/assert"
+)
+
+func TestParseTestPhases(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TestPhases
+		wantErr bool
+	}{
+		{"ping", TestPhases{PhasePing}, false},
+		{"download, upload", TestPhases{PhaseDownload, PhaseUpload}, false},
+		{"ping,ping,upload,", TestPhases{PhasePing, PhaseUpload}, false},
+		{"", nil, true},
+		{",", nil, true},
+		{"ping,packet_loss", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseTestPhases(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestTestPhases(t *testing.T) {
+	assert := assert.New(t)
+	var all TestPhases
+	assert.True(all.Has(PhasePing))
+	assert.True(all.Has(PhaseUpload))
+	assert.True(all.full())
+	assert.Equal("ping,download,upload", all.String())
+
+	ping := TestPhases{PhasePing}
+	assert.True(ping.Has(PhasePing))
+	assert.False(ping.Has(PhaseDownload))
+	assert.False(ping.full())
+	assert.Equal("ping", ping.String())
+
+	assert.False(TestPhases{PhaseDownload}.full())
+	assert.True(TestPhases{PhaseUpload, PhaseDownload}.full())
+
+	// selecting every phase, in any order, is the same as selecting none
+	assert.Nil(TestPhases{PhaseUpload, PhasePing, PhaseDownload}.normalize())
+	assert.Equal(TestPhases{PhasePing, PhaseUpload}, TestPhases{PhasePing, PhaseUpload}.normalize())
+	// so runs with the default config record no phases
+	e := New(Opts{Phases: TestPhases{PhasePing, PhaseDownload, PhaseUpload}})
+	assert.Nil(e.defaultSpec().phases)
+}
@@ -0,0 +1,119 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"speedtest-exporter/internal/icmp_ping"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// PingMode selects how latency to speedtest servers is measured.
+type PingMode string
+
+const (
+	// PingModeHTTP times HTTP requests for a small file on the server, which
+	// includes the server's time to respond.
+	PingModeHTTP PingMode = "http"
+	// PingModeTCP times PING commands over the speedtest protocol's TCP
+	// connection.
+	PingModeTCP PingMode = "tcp"
+	// PingModeICMP times ICMP echo requests, sent from unprivileged datagram
+	// sockets.
+	PingModeICMP PingMode = "icmp"
+)
+
+// ParsePingMode parses a PingMode from its string representation.
+func ParsePingMode(s string) (PingMode, error) {
+	switch mode := PingMode(s); mode {
+	case PingModeHTTP, PingModeTCP, PingModeICMP:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown ping mode %q", s)
+}
+
+func (m PingMode) MarshalText() ([]byte, error) {
+	return []byte(m), nil
+}
+
+func (m *PingMode) UnmarshalText(text []byte) error {
+	mode, err := ParsePingMode(string(text))
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+const (
+	// defaultPingCount is the number of pings sent to each server by
+	// default, as in speedtest-go.
+	defaultPingCount = 10
+	// pingInterval is the time between pings.
+	pingInterval = 200 * time.Millisecond
+)
+
+// pingServer sends count pings to srv, setting its latency statistics. sample
+// is called with the round trip time of each ping which is answered.
+func pingServer(ctx context.Context, srv *speedtest.Server, mode PingMode, count int, sample func(time.Duration)) error {
+	var latencies []int64
+	var err error
+	switch mode {
+	case PingModeTCP:
+		latencies, err = srv.TCPPing(ctx, count, pingInterval, sample)
+	case PingModeICMP:
+		latencies, err = icmpPing(ctx, srv, count, sample)
+	default:
+		latencies, err = srv.HTTPPing(ctx, count, pingInterval, sample)
+	}
+	if err != nil {
+		return fmt.Errorf("%s ping failed: %w", mode, err)
+	}
+	if len(latencies) == 0 {
+		return fmt.Errorf("%s ping failed: %w", mode, errors.New("no replies"))
+	}
+	mean, _, stdDev, minLatency, maxLatency := speedtest.StandardDeviation(latencies)
+	srv.Latency = time.Duration(mean)
+	srv.Jitter = time.Duration(stdDev)
+	srv.MinLatency = time.Duration(minLatency)
+	srv.MaxLatency = time.Duration(maxLatency)
+	return nil
+}
+
+// icmpPing pings the host of srv, returning latencies in nanoseconds.
+func icmpPing(ctx context.Context, srv *speedtest.Server, count int, sample func(time.Duration)) ([]int64, error) {
+	host, err := serverHostname(srv)
+	if err != nil {
+		return nil, err
+	}
+	rtts, err := icmp_ping.Ping(ctx, host, count, pingInterval)
+	if err != nil {
+		return nil, err
+	}
+	latencies := make([]int64, 0, len(rtts))
+	for _, rtt := range rtts {
+		sample(rtt)
+		latencies = append(latencies, rtt.Nanoseconds())
+	}
+	return latencies, nil
+}
+
+// serverHostname returns the hostname of srv, without its port.
+func serverHostname(srv *speedtest.Server) (string, error) {
+	if srv.Host != "" {
+		host, _, err := net.SplitHostPort(srv.Host)
+		if err != nil {
+			return srv.Host, nil
+		}
+		return host, nil
+	}
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		return "", err
+	}
+	return u.Hostname(), nil
+}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"speedtest-exporter/internal/icmp_ping"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func TestParsePingMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PingMode
+		wantErr bool
+	}{
+		{"http", PingModeHTTP, false},
+		{"tcp", PingModeTCP, false},
+		{"icmp", PingModeICMP, false},
+		{"", "", true},
+		{"udp", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParsePingMode(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// closedAddr returns the address of a local port with no listener.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	return addr
+}
+
+func TestPingServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	e := New(Opts{Doer: NewTestClient(), Ctx: ctx})
+	serverList, err := e.speedtest.FetchServerListContext(ctx)
+	require.NoError(t, err)
+
+	t.Run("http", func(t *testing.T) {
+		assert := assert.New(t)
+		srv := *serverList[0]
+		srv.Latency, srv.Jitter, srv.MinLatency, srv.MaxLatency = 0, 0, 0, 0
+		samples := []time.Duration{}
+		require.NoError(t, pingServer(ctx, &srv, PingModeHTTP, 3, func(d time.Duration) {
+			samples = append(samples, d)
+		}))
+		assert.Len(samples, 3)
+		assert.Greater(srv.Latency, time.Duration(0))
+		assert.LessOrEqual(srv.MinLatency, srv.Latency)
+		assert.GreaterOrEqual(srv.MaxLatency, srv.Latency)
+	})
+
+	t.Run("tcp_unreachable", func(t *testing.T) {
+		srv := *serverList[0]
+		srv.Host = closedAddr(t)
+		err := pingServer(ctx, &srv, PingModeTCP, 3, func(time.Duration) {})
+		require.ErrorContains(t, err, "tcp ping failed")
+	})
+
+	t.Run("icmp", func(t *testing.T) {
+		if err := icmp_ping.Check(); errors.Is(err, icmp_ping.ErrNotPermitted) {
+			err := pingServer(ctx, &speedtest.Server{Host: "127.0.0.1:8080"}, PingModeICMP, 3, func(time.Duration) {})
+			require.ErrorIs(t, err, icmp_ping.ErrNotPermitted)
+			return
+		}
+		srv := &speedtest.Server{Host: "127.0.0.1:8080"}
+		samples := 0
+		require.NoError(t, pingServer(ctx, srv, PingModeICMP, 3, func(time.Duration) {
+			samples++
+		}))
+		assert.Equal(t, 3, samples)
+		assert.Greater(t, srv.Latency, time.Duration(0))
+	})
+}
+
+func TestServerHostname(t *testing.T) {
+	tests := []struct {
+		desc string
+		srv  speedtest.Server
+		want string
+	}{
+		{"host_with_port", speedtest.Server{Host: "speedtest.example.net:8080"}, "speedtest.example.net"},
+		{"host_without_port", speedtest.Server{Host: "speedtest.example.net"}, "speedtest.example.net"},
+		{"ipv6_host", speedtest.Server{Host: "[::1]:8080"}, "::1"},
+		{"url", speedtest.Server{URL: "http://speedtest.example.net:8080/speedtest/upload.php"}, "speedtest.example.net"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got, err := serverHostname(&tt.srv)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"speedtest-exporter/internal/bandwidth_observer"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+const (
+	// scrapeTimeoutHeader is set by Prometheus to the scrape timeout, in
+	// seconds, of the scrape being served.
+	scrapeTimeoutHeader = "X-Prometheus-Scrape-Timeout-Seconds"
+	// probeTimeoutOffset is subtracted from the scrape timeout to leave time
+	// to respond before Prometheus gives up on the scrape.
+	probeTimeoutOffset = 500 * time.Millisecond
+)
+
+// ProbeMode selects how a probe's speedtest is run.
+type ProbeMode string
+
+const (
+	ProbeModeNormal ProbeMode = "normal"
+	ProbeModeSaving ProbeMode = "saving"
+)
+
+// ProbeHandler returns a blackbox_exporter style handler, which synchronously
+// runs a speedtest against the server given by the server_id parameter, and
+// responds with the results of that run alone. If server_id is omitted, the
+// closest server is tested. The mode parameter may be "normal" or "saving" to
+// override the exporter's saving mode for this probe, and the phases parameter
+// a comma separated list of phases to run, e.g. "ping", overriding the
+// exporter's test phases.
+func (e *SpeedtestExporter) ProbeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		spec := e.defaultSpec()
+		switch mode := ProbeMode(params.Get("mode")); mode {
+		case "":
+		case ProbeModeNormal:
+			spec.savingMode = false
+		case ProbeModeSaving:
+			spec.savingMode = true
+		default:
+			http.Error(w, fmt.Sprintf("unknown mode %q", mode), http.StatusBadRequest)
+			return
+		}
+		if params.Has("phases") {
+			phases, err := ParseTestPhases(params.Get("phases"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			spec.phases = phases.normalize()
+		}
+
+		timeout, err := probeTimeout(r, e.currentSettings().testTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Whether the speedtest probe succeeded",
+		})
+		probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_duration_seconds",
+			Help: "Duration of the speedtest probe in seconds",
+		})
+		// Probes time their runs separately, so ad hoc targets don't skew the
+		// exporter's own timings.
+		timers := newRunTimers(e.schema)
+		start := time.Now()
+		results, err := e.probe(ctx, params.Get("server_id"), spec, timers)
+		probeDuration.Set(time.Since(start).Seconds())
+		if err != nil {
+			log.Error().Err(err).Str("server_id", params.Get("server_id")).Msg("Probe failed")
+		} else {
+			probeSuccess.Set(1)
+		}
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(probeSuccess, probeDuration, timers, resultCollector{e.metrics, results})
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// probeTimeout returns the timeout for a probe, derived from the Prometheus
+// scrape timeout if present, and capped by the exporter's test timeout.
+func probeTimeout(r *http.Request, testTimeout time.Duration) (time.Duration, error) {
+	header := r.Header.Get(scrapeTimeoutHeader)
+	if header == "" {
+		return testTimeout, nil
+	}
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s header %q: %w", scrapeTimeoutHeader, header, err)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > probeTimeoutOffset {
+		timeout -= probeTimeoutOffset
+	}
+	if timeout > testTimeout {
+		timeout = testTimeout
+	}
+	return timeout, nil
+}
+
+// probe runs a speedtest against a single server, recording its durations on
+// timers, and returning an error if the server can't be found or the test
+// fails.
+func (e *SpeedtestExporter) probe(ctx context.Context, serverID string, spec testSpec, timers *runTimers) ([]Result, error) {
+	if err := e.acquireTester(ctx); err != nil {
+		return nil, err
+	}
+	defer e.releaseTester()
+	spec, err := e.applyBudget(spec, 1)
+	if err != nil {
+		return nil, err
+	}
+	usage := &bandwidth_observer.Usage{}
+	ctx = bandwidth_observer.WithUsage(ctx, usage)
+	servers := 0
+	defer func() {
+		e.recordUsage(usage, servers, spec)
+	}()
+
+	target, err := e.findProbeTarget(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	results := e.runSpeedtest(ctx, speedtest.Servers{target}, spec, timers)
+	servers = len(results)
+	for _, r := range results {
+		if !r.Success() {
+			return results, fmt.Errorf("speedtest against server %s failed: %s", r.Server.ID, r.Error)
+		}
+	}
+	return results, nil
+}
+
+func (e *SpeedtestExporter) findProbeTarget(ctx context.Context, serverID string) (*speedtest.Server, error) {
+	if _, err := e.fetchClient(ctx); err != nil {
+		return nil, err
+	}
+	serverList, err := e.fetchServerList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if serverID == "" {
+		closest, err := closestServers(serverList, 1, nil)
+		if err != nil {
+			return nil, err
+		}
+		return closest[0], nil
+	}
+	if srv := findServerByID(serverList, serverID); srv != nil {
+		return srv, nil
+	}
+	// The server list only contains servers near the caller, so look up
+	// servers further afield individually.
+	return e.speedtest.FetchServerByIDContext(bandwidth_observer.WithPhase(ctx, PhaseServerList), serverID)
+}
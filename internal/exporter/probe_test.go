@@ -0,0 +1,222 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func TestProbeHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer: NewTestClient(),
+		Ctx:  ctx,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+
+	srv := httptest.NewServer(e.ProbeHandler())
+	defer srv.Close()
+
+	tests := []struct {
+		desc       string
+		query      string
+		wantStatus int
+		match      []*regexp.Regexp
+	}{
+		{
+			"closest",
+			"",
+			http.StatusOK,
+			[]*regexp.Regexp{
+				regexp.MustCompile(`(?m)^probe_success 1$`),
+				regexp.MustCompile(`(?m)^speedtest_download_speed_mbps{.*server_id="[12]".*} [0-9e+\.]+$`),
+			},
+		},
+		{
+			"pinned",
+			"?server_id=2&mode=saving",
+			http.StatusOK,
+			[]*regexp.Regexp{
+				regexp.MustCompile(`(?m)^probe_success 1$`),
+				regexp.MustCompile(`(?m)^probe_duration_seconds [0-9e+\-\.]+$`),
+				regexp.MustCompile(`(?m)^speedtest_download_speed_mbps{.*server_id="2".*} [0-9e+\.]+$`),
+			},
+		},
+		{
+			"unreachable",
+			"?server_id=3",
+			http.StatusOK,
+			[]*regexp.Regexp{
+				regexp.MustCompile(`(?m)^probe_success 0$`),
+			},
+		},
+		{
+			"unknown_server",
+			"?server_id=999",
+			http.StatusOK,
+			[]*regexp.Regexp{
+				regexp.MustCompile(`(?m)^probe_success 0$`),
+			},
+		},
+		{
+			"invalid_mode",
+			"?mode=turbo",
+			http.StatusBadRequest,
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			resp, err := srv.Client().Get(srv.URL + tt.query)
+			require.NoError(err)
+			defer resp.Body.Close()
+			assert.Equal(tt.wantStatus, resp.StatusCode)
+
+			buf, err := io.ReadAll(resp.Body)
+			require.NoError(err)
+			for _, match := range tt.match {
+				assert.True(match.Match(buf), "Regex %s didn't match a line! buf: %s", match.String(), string(buf))
+			}
+		})
+	}
+}
+
+func TestProbePhases(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer: NewTestClient(),
+		Ctx:  ctx,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+
+	srv := httptest.NewServer(e.ProbeHandler())
+	defer srv.Close()
+
+	tests := []struct {
+		desc       string
+		query      string
+		wantStatus int
+		want       []string
+		notWant    []string
+	}{
+		{
+			"ping",
+			"?server_id=1&phases=ping",
+			http.StatusOK,
+			[]string{"speedtest_latency_ms", "speedtest_jitter_ms"},
+			[]string{"speedtest_download_speed_mbps", "speedtest_upload_speed_mbps"},
+		},
+		{
+			"throughput",
+			"?server_id=1&phases=download,upload",
+			http.StatusOK,
+			[]string{"speedtest_download_speed_mbps", "speedtest_upload_speed_mbps"},
+			[]string{"speedtest_latency_ms", "speedtest_jitter_ms"},
+		},
+		{
+			"upload",
+			"?server_id=1&phases=upload",
+			http.StatusOK,
+			[]string{"speedtest_upload_speed_mbps"},
+			[]string{"speedtest_latency_ms", "speedtest_download_speed_mbps"},
+		},
+		{"empty", "?phases=", http.StatusBadRequest, nil, nil},
+		{"unknown", "?phases=ping,jitter", http.StatusBadRequest, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			resp, err := srv.Client().Get(srv.URL + tt.query)
+			require.NoError(err)
+			defer resp.Body.Close()
+			assert.Equal(tt.wantStatus, resp.StatusCode)
+
+			buf, err := io.ReadAll(resp.Body)
+			require.NoError(err)
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			assert.Contains(string(buf), "probe_success 1")
+			for _, name := range tt.want {
+				assert.Regexp(`(?m)^`+name+`{`, string(buf))
+			}
+			for _, name := range tt.notWant {
+				assert.NotRegexp(`(?m)^`+name+`{`, string(buf))
+			}
+		})
+	}
+}
+
+func TestProbeTimings(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	e := New(Opts{
+		Doer: NewTestClient(),
+		Ctx:  ctx,
+	})
+	e.speedtest.SetCaptureTime(100 * time.Millisecond)
+
+	srv := httptest.NewServer(e.ProbeHandler())
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL + "?server_id=1")
+	require.NoError(err)
+	defer resp.Body.Close()
+	buf, err := io.ReadAll(resp.Body)
+	require.NoError(err)
+
+	// the probe reports its own timings
+	assert.Regexp(`(?m)^speedtest_phase_duration_seconds_count{phase="download"} 1$`, string(buf))
+	assert.Regexp(`(?m)^speedtest_ping_rtt_seconds_count{ping_mode="http",server_id="1"} [1-9][0-9]*$`, string(buf))
+	assert.Regexp(`(?m)^speedtest_test_duration_ms [0-9e+\-\.]+$`, string(buf))
+	// but doesn't affect the exporter's
+	assert.Equal(0, testutil.CollectAndCount(e, "speedtest_phase_duration_seconds", "speedtest_ping_rtt_seconds"))
+	assert.Equal(0.0, testutil.ToFloat64(e.timers.testDuration))
+}
+
+func TestProbeTimeout(t *testing.T) {
+	tests := []struct {
+		desc    string
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"no_header", "", time.Minute, false},
+		{"header", "10", 9500 * time.Millisecond, false},
+		{"capped", "120", time.Minute, false},
+		{"short", "0.25", 250 * time.Millisecond, false},
+		{"invalid", "soon", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			r := httptest.NewRequest(http.MethodGet, "/probe", nil)
+			if tt.header != "" {
+				r.Header.Set(scrapeTimeoutHeader, tt.header)
+			}
+			got, err := probeTimeout(r, time.Minute)
+			if tt.wantErr {
+				assert.Error(err)
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package exporter
+
+import (
+	"fmt"
+	"slices"
+	"speedtest-exporter/internal/metric_schema"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// serverLabels are the labels which per-server metrics may carry. v1 metrics
+// carry all of them by default.
+var serverLabels = []string{"server_id", "url", "name", "country", "sponsor", "lat", "lon", "distance"}
+
+var (
+	server_info = prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", "server_info"),
+		"Info about a Speedtest Server from the last speedtest run against it",
+		[]string{"server_id", "name", "sponsor", "country", "host", "url", "lat", "lon"},
+		nil,
+	)
+	server_distance = prometheus.NewDesc(
+		prometheus.BuildFQName("speedtest", "", "server_distance_km"),
+		"Distance from the client to a Speedtest Server in kilometers",
+		[]string{"server_id"},
+		nil,
+	)
+)
+
+// DefaultServerLabels returns the labels per-server metrics carry by default
+// in schema. v1 keeps every label for compatibility with existing dashboards,
+// while v2 only identifies servers by ID, leaving their metadata to
+// speedtest_server_info.
+func DefaultServerLabels(schema metric_schema.Schema) []string {
+	if schema == metric_schema.V2 {
+		return []string{"server_id"}
+	}
+	return AllServerLabels()
+}
+
+// AllServerLabels returns every label per-server metrics may carry.
+func AllServerLabels() []string {
+	return slices.Clone(serverLabels)
+}
+
+// ParseServerLabels parses a comma separated list of server labels, or "all"
+// for AllServerLabels.
+func ParseServerLabels(s string) ([]string, error) {
+	if strings.TrimSpace(s) == "all" {
+		return AllServerLabels(), nil
+	}
+	labels := []string{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		labels = append(labels, field)
+	}
+	if err := ValidateServerLabels(labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// ValidateServerLabels checks that labels are known server labels without
+// duplicates, and include server_id, which metrics are joined on.
+func ValidateServerLabels(labels []string) error {
+	seen := map[string]bool{}
+	for _, label := range labels {
+		if !slices.Contains(serverLabels, label) {
+			return fmt.Errorf("unknown server label %q, must be one of %s", label, strings.Join(serverLabels, ", "))
+		}
+		if seen[label] {
+			return fmt.Errorf("duplicate server label %q", label)
+		}
+		seen[label] = true
+	}
+	if !seen["server_id"] {
+		return fmt.Errorf("server labels must include server_id")
+	}
+	return nil
+}
+
+func serverLabelValue(s *speedtest.Server, label string) string {
+	switch label {
+	case "server_id":
+		return s.ID
+	case "url":
+		return s.URL
+	case "name":
+		return s.Name
+	case "country":
+		return s.Country
+	case "sponsor":
+		return s.Sponsor
+	case "lat":
+		return s.Lat
+	case "lon":
+		return s.Lon
+	case "distance":
+		return fmt.Sprintf("%f", s.Distance)
+	}
+	return ""
+}
+
+// collectServerInfo emits speedtest_server_info and
+// speedtest_server_distance_km for s.
+func collectServerInfo(ch chan<- prometheus.Metric, s *speedtest.Server) {
+	ch <- prometheus.MustNewConstMetric(server_info, prometheus.GaugeValue, 1, s.ID, s.Name, s.Sponsor, s.Country, s.Host, s.URL, s.Lat, s.Lon)
+	ch <- prometheus.MustNewConstMetric(server_distance, prometheus.GaugeValue, s.Distance, s.ID)
+}
@@ -0,0 +1,89 @@
+package exporter
+
+import (
+	"speedtest-exporter/internal/metric_schema"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/showwin/speedtest-go/speedtest"
+	"github.com/tj/assert"
+)
+
+func TestParseServerLabels(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"server_id", []string{"server_id"}, false},
+		{"server_id, name,country", []string{"server_id", "name", "country"}, false},
+		{"name,server_id,", []string{"name", "server_id"}, false},
+		{"", nil, true},
+		{"name", nil, true},
+		{"server_id,host", nil, true},
+		{"server_id,name,name", nil, true},
+		{" all", serverLabels, false},
+		{"all,server_id", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseServerLabels(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDefaultServerLabels(t *testing.T) {
+	assert.Equal(t, serverLabels, DefaultServerLabels(metric_schema.V1))
+	assert.Equal(t, []string{"server_id"}, DefaultServerLabels(metric_schema.V2))
+	assert.Equal(t, serverLabels, AllServerLabels())
+	// callers can't modify the full set
+	AllServerLabels()[0] = "modified"
+	assert.Equal(t, "server_id", serverLabels[0])
+}
+
+func TestServerLabels(t *testing.T) {
+	assert := assert.New(t)
+	e := New(Opts{ServerLabels: []string{"server_id", "country"}})
+	e.cache.Set([]Result{{
+		Server: &speedtest.Server{
+			ID:       "1",
+			URL:      "http://speedtest.example.net:8080/speedtest/upload.php",
+			Host:     "speedtest.example.net:8080",
+			Name:     "Anytown",
+			Country:  "US",
+			Sponsor:  "Sponsor",
+			Lat:      "1.0",
+			Lon:      "-1.0",
+			Distance: 1.5,
+			Latency:  10 * time.Millisecond,
+			DLSpeed:  125000,
+		},
+		Timestamp: time.Now(),
+	}})
+
+	assert.NoError(testutil.CollectAndCompare(e, strings.NewReader(`
+# HELP speedtest_download_speed_mbps Download speed from Speedtest Server in bytes per second
+# TYPE speedtest_download_speed_mbps gauge
+speedtest_download_speed_mbps{country="US",server_id="1"} 125000
+# HELP speedtest_latency_ms Average latency to Speedtest Server in milliseconds
+# TYPE speedtest_latency_ms gauge
+speedtest_latency_ms{country="US",server_id="1"} 10
+# HELP speedtest_server_success Whether the last speedtest run against this server succeeded
+# TYPE speedtest_server_success gauge
+speedtest_server_success{country="US",server_id="1"} 1
+# HELP speedtest_server_info Info about a Speedtest Server from the last speedtest run against it
+# TYPE speedtest_server_info gauge
+speedtest_server_info{country="US",host="speedtest.example.net:8080",lat="1.0",lon="-1.0",name="Anytown",server_id="1",sponsor="Sponsor",url="http://speedtest.example.net:8080/speedtest/upload.php"} 1
+# HELP speedtest_server_distance_km Distance from the client to a Speedtest Server in kilometers
+# TYPE speedtest_server_distance_km gauge
+speedtest_server_distance_km{server_id="1"} 1.5
+`), "speedtest_download_speed_mbps", "speedtest_latency_ms", "speedtest_server_success", "speedtest_server_info", "speedtest_server_distance_km"))
+}
@@ -0,0 +1,74 @@
+package exporter
+
+import "sync"
+
+// singleFlight coalesces concurrent calls into a single execution, so that
+// e.g. scrapes from an HA pair of Prometheus servers share one speedtest run
+// rather than stacking them. Each call is identified by an ID, so callers can
+// tell which call they were coalesced into.
+type singleFlight struct {
+	mut     sync.Mutex
+	current *flight
+}
+
+type flight struct {
+	id   string
+	done chan struct{}
+}
+
+// Do runs fn as the call with the given id, unless a previous call is still in
+// flight, in which case it waits for that call to complete instead. It returns
+// the ID of the call which ran, and reports whether fn was run by this caller.
+func (s *singleFlight) Do(id string, fn func()) (string, bool) {
+	f, started := s.start(id)
+	if !started {
+		<-f.done
+		return f.id, false
+	}
+	defer s.finish()
+	fn()
+	return id, true
+}
+
+// Go is like Do, but runs fn in a new goroutine rather than waiting for it or
+// the call in flight to complete.
+func (s *singleFlight) Go(id string, fn func()) (string, bool) {
+	f, started := s.start(id)
+	if !started {
+		return f.id, false
+	}
+	go func() {
+		defer s.finish()
+		fn()
+	}()
+	return id, true
+}
+
+// InFlight returns the ID of the call in flight, if any.
+func (s *singleFlight) InFlight() (string, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.current == nil {
+		return "", false
+	}
+	return s.current.id, true
+}
+
+// start returns the call in flight, or starts a new one with the given id,
+// reporting whether it did so.
+func (s *singleFlight) start(id string) (*flight, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.current != nil {
+		return s.current, false
+	}
+	s.current = &flight{id: id, done: make(chan struct{})}
+	return s.current, true
+}
+
+func (s *singleFlight) finish() {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	close(s.current.done)
+	s.current = nil
+}
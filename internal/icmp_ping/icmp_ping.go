@@ -0,0 +1,152 @@
+package icmp_ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// ErrNotPermitted is returned when the exporter isn't allowed to open
+// unprivileged ICMP sockets.
+var ErrNotPermitted = errors.New("unprivileged ICMP sockets aren't permitted for this user; on Linux, allow them for the exporter's group with the net.ipv4.ping_group_range sysctl, e.g. sysctl -w net.ipv4.ping_group_range=\"0 2147483647\", or use another ping mode")
+
+// replyTimeout is how long to wait for the reply to each echo request.
+const replyTimeout = 2 * time.Second
+
+// payload is sent in each echo request, and identifies replies to them.
+var payload = []byte("speedtest-exporter")
+
+// Check returns ErrNotPermitted if the exporter isn't allowed to open
+// unprivileged ICMP sockets.
+func Check() error {
+	conn, err := listen(net.IPv4(127, 0, 0, 1))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func listen(ip net.IP) (*icmp.PacketConn, error) {
+	network, address := "udp4", "0.0.0.0"
+	if ip.To4() == nil {
+		network, address = "udp6", "::"
+	}
+	// "udp" networks open unprivileged datagram sockets, rather than the raw
+	// sockets "ip" networks need.
+	conn, err := icmp.ListenPacket(network, address)
+	if err != nil {
+		if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EPROTONOSUPPORT) {
+			return nil, fmt.Errorf("%w: %w", ErrNotPermitted, err)
+		}
+		return nil, fmt.Errorf("failed to open ICMP socket: %w", err)
+	}
+	return conn, nil
+}
+
+// Ping sends count ICMP echo requests to host, interval apart, and returns the
+// round trip times of those which were answered. It fails if none were.
+func Ping(ctx context.Context, host string, count int, interval time.Duration) ([]time.Duration, error) {
+	addr, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addr) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	ip := addr[0].IP
+	conn, err := listen(ip)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Unblock reads if the context is done before they time out.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	var echoType icmp.Type = ipv4.ICMPTypeEcho
+	protocol := 1 // ICMP for IPv4
+	if ip.To4() == nil {
+		echoType = ipv6.ICMPTypeEchoRequest
+		protocol = 58 // ICMP for IPv6
+	}
+	id := os.Getpid() & 0xffff
+	rtts := []time.Duration{}
+	var lastErr error
+	for seq := 0; seq < count; seq++ {
+		if seq > 0 {
+			select {
+			case <-ctx.Done():
+				return rtts, ctx.Err()
+			case <-time.After(interval):
+			}
+		}
+		msg := icmp.Message{
+			Type: echoType,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: payload},
+		}
+		rtt, err := echo(ctx, conn, &net.UDPAddr{IP: ip}, msg, protocol)
+		if err != nil {
+			if ctx.Err() != nil {
+				return rtts, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		rtts = append(rtts, rtt)
+	}
+	if len(rtts) == 0 {
+		return nil, fmt.Errorf("no replies to ICMP echo requests to %s: %w", ip, lastErr)
+	}
+	return rtts, nil
+}
+
+// echo sends msg to addr, and waits for its reply.
+func echo(ctx context.Context, conn *icmp.PacketConn, addr net.Addr, msg icmp.Message, protocol int) (time.Duration, error) {
+	b, err := msg.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if _, err := conn.WriteTo(b, addr); err != nil {
+		return 0, err
+	}
+	deadline := start.Add(replyTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	seq := msg.Body.(*icmp.Echo).Seq
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return 0, err
+		}
+		reply, err := icmp.ParseMessage(protocol, buf[:n])
+		if err != nil {
+			continue
+		}
+		// The kernel sets the ID of unprivileged echo requests, so replies
+		// are matched on their sequence number and payload alone.
+		body, ok := reply.Body.(*icmp.Echo)
+		if !ok || body.Seq != seq || string(body.Data) != string(payload) {
+			continue
+		}
+		if reply.Type != ipv4.ICMPTypeEchoReply && reply.Type != ipv6.ICMPTypeEchoReply {
+			continue
+		}
+		return time.Since(start), nil
+	}
+}
@@ -0,0 +1,40 @@
+package icmp_ping
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func TestPing(t *testing.T) {
+	if err := Check(); errors.Is(err, ErrNotPermitted) {
+		t.Skip(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rtts, err := Ping(ctx, "127.0.0.1", 3, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Len(t, rtts, 3)
+	for _, rtt := range rtts {
+		assert.Greater(t, rtt, time.Duration(0))
+	}
+}
+
+func TestPingCancelled(t *testing.T) {
+	if err := Check(); errors.Is(err, ErrNotPermitted) {
+		t.Skip(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Ping(ctx, "127.0.0.1", 3, time.Second)
+	assert.Error(t, err)
+}
+
+func TestPingUnknownHost(t *testing.T) {
+	_, err := Ping(context.Background(), "nonexistent.invalid", 1, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package metric_schema
+
+import "fmt"
+
+// Schema selects the names and units of exported metrics.
+type Schema string
+
+const (
+	// V1 is the original metric schema, kept so existing dashboards keep
+	// working. Despite their names, some v1 metrics aren't in the units their
+	// suffixes suggest.
+	V1 Schema = "v1"
+	// V2 follows the Prometheus naming conventions, using base units and a
+	// _total suffix on counters.
+	V2 Schema = "v2"
+)
+
+// Parse parses a Schema from its string representation.
+func Parse(s string) (Schema, error) {
+	switch schema := Schema(s); schema {
+	case V1, V2:
+		return schema, nil
+	}
+	return "", fmt.Errorf("unknown metric schema %q", s)
+}
+
+func (s Schema) MarshalText() ([]byte, error) {
+	return []byte(s), nil
+}
+
+func (s *Schema) UnmarshalText(text []byte) error {
+	schema, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*s = schema
+	return nil
+}
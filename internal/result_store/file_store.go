@@ -0,0 +1,164 @@
+package result_store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// fileStore persists records to a file, one JSON encoded record per line.
+// Records are also held in memory, so reads don't touch the disk.
+type fileStore struct {
+	path string
+	file *os.File
+	// records are those within retention. The file may hold older records
+	// too, until enough have built up to be worth rewriting it.
+	records []Record
+	// lines is the number of records in the file.
+	lines     int
+	retention Retention
+	mut       sync.RWMutex
+}
+
+// pruneSlack returns how many records outside of retention the file may hold
+// alongside n records within it before it's rewritten, so the file isn't
+// rewritten on every append once it's full.
+func pruneSlack(n int) int {
+	return max(n/10, 1)
+}
+
+// NewFileStore returns a Store which persists records to the file at path,
+// loading any records already in the file.
+func NewFileStore(path string, retention Retention) (Store, error) {
+	records, err := readRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &fileStore{
+		path:      path,
+		records:   records,
+		retention: retention,
+	}
+	// Rewrite the file up front, which both applies retention to the loaded
+	// records and drops any corrupt lines.
+	if err := f.rewrite(retention.prune(records, time.Now())); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func readRecords(path string) ([]Record, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []Record{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open result store: %w", err)
+	}
+	defer file.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Warn().Err(err).Str("path", path).Int("line", line).Msg("Skipping corrupt result store record")
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read result store: %w", err)
+	}
+	return records, nil
+}
+
+// rewrite atomically replaces the file with records, and reopens it for
+// appending. Callers must hold the write lock, or have exclusive access.
+func (f *fileStore) rewrite(records []Record) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to create result store: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, record := range records {
+		if err := enc.Encode(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write result store: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write result store: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write result store: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), f.path); err != nil {
+		return fmt.Errorf("failed to replace result store: %w", err)
+	}
+
+	if f.file != nil {
+		f.file.Close()
+	}
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open result store: %w", err)
+	}
+	f.file = file
+	f.records = records
+	f.lines = len(records)
+	return nil
+}
+
+func (f *fileStore) Append(record Record) error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	records := f.retention.prune(append(f.records, record), time.Now())
+	if stale := f.lines + 1 - len(records); stale > pruneSlack(len(records)) {
+		return f.rewrite(records)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode result store record: %w", err)
+	}
+	if _, err := f.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write result store: %w", err)
+	}
+	f.records = records
+	f.lines++
+	return nil
+}
+
+func (f *fileStore) List(limit int) ([]Record, error) {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	return newestFirst(f.records, limit), nil
+}
+
+func (f *fileStore) Get(id string) (Record, bool, error) {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+	for _, record := range f.records {
+		if record.ID == id {
+			return record, true, nil
+		}
+	}
+	return Record{}, false, nil
+}
+
+func (f *fileStore) Close() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,105 @@
+package result_store
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Record is a single speedtest run, as persisted by a Store. Data is opaque to
+// the store.
+type Record struct {
+	ID        string          `json:"id"`
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// Store persists the history of speedtest runs.
+type Store interface {
+	// Append adds a record to the store, pruning any records which fall
+	// outside of the store's retention.
+	Append(Record) error
+	// List returns up to limit records, newest first. A limit of zero or less
+	// returns all records.
+	List(limit int) ([]Record, error)
+	// Get returns the record with the given ID, if present.
+	Get(id string) (Record, bool, error)
+	Close() error
+}
+
+// Retention limits how many records a Store keeps. Zero values are unlimited.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxCount int
+}
+
+// prune returns the suffix of records, which must be ordered oldest first,
+// which is within the retention limits.
+func (r Retention) prune(records []Record, now time.Time) []Record {
+	if r.MaxCount > 0 && len(records) > r.MaxCount {
+		records = records[len(records)-r.MaxCount:]
+	}
+	if r.MaxAge > 0 {
+		cutoff := now.Add(-r.MaxAge)
+		for len(records) > 0 && records[0].Timestamp.Before(cutoff) {
+			records = records[1:]
+		}
+	}
+	return records
+}
+
+// memoryStore keeps records in memory, in the order they were appended.
+type memoryStore struct {
+	records   []Record
+	retention Retention
+	mut       sync.RWMutex
+}
+
+// NewMemoryStore returns a Store which keeps records in memory only.
+func NewMemoryStore(retention Retention) Store {
+	return &memoryStore{
+		records:   []Record{},
+		retention: retention,
+	}
+}
+
+func (m *memoryStore) Append(record Record) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.records = m.retention.prune(append(m.records, record), time.Now())
+	return nil
+}
+
+func (m *memoryStore) List(limit int) ([]Record, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return newestFirst(m.records, limit), nil
+}
+
+func (m *memoryStore) Get(id string) (Record, bool, error) {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	for _, record := range m.records {
+		if record.ID == id {
+			return record, true, nil
+		}
+	}
+	return Record{}, false, nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
+
+// newestFirst returns up to limit of records, which must be ordered oldest
+// first, in reverse order.
+func newestFirst(records []Record, limit int) []Record {
+	if limit <= 0 || limit > len(records) {
+		limit = len(records)
+	}
+	ret := make([]Record, 0, limit)
+	for i := len(records) - 1; i >= len(records)-limit; i-- {
+		ret = append(ret, records[i])
+	}
+	return ret
+}
@@ -0,0 +1,170 @@
+package result_store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func record(i int, ts time.Time) Record {
+	return Record{
+		ID:        fmt.Sprint(i),
+		Timestamp: ts,
+		Data:      json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)),
+	}
+}
+
+func ids(records []Record) []string {
+	ret := []string{}
+	for _, r := range records {
+		ret = append(ret, r.ID)
+	}
+	return ret
+}
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T, retention Retention) Store{
+		"memory": func(t *testing.T, retention Retention) Store {
+			return NewMemoryStore(retention)
+		},
+		"file": func(t *testing.T, retention Retention) Store {
+			s, err := NewFileStore(filepath.Join(t.TempDir(), "history.jsonl"), retention)
+			require.NoError(t, err)
+			return s
+		},
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			t.Run("append_list_get", func(t *testing.T) {
+				assert := assert.New(t)
+				require := require.New(t)
+				s := newStore(t, Retention{})
+				defer s.Close()
+				now := time.Now()
+				for i := 0; i < 3; i++ {
+					require.NoError(s.Append(record(i, now)))
+				}
+				records, err := s.List(0)
+				require.NoError(err)
+				assert.Equal([]string{"2", "1", "0"}, ids(records))
+				records, err = s.List(2)
+				require.NoError(err)
+				assert.Equal([]string{"2", "1"}, ids(records))
+
+				r, ok, err := s.Get("1")
+				require.NoError(err)
+				assert.True(ok)
+				assert.JSONEq(`{"n":1}`, string(r.Data))
+				_, ok, err = s.Get("missing")
+				require.NoError(err)
+				assert.False(ok)
+			})
+			t.Run("max_count", func(t *testing.T) {
+				require := require.New(t)
+				s := newStore(t, Retention{MaxCount: 2})
+				defer s.Close()
+				for i := 0; i < 5; i++ {
+					require.NoError(s.Append(record(i, time.Now())))
+				}
+				records, err := s.List(0)
+				require.NoError(err)
+				assert.Equal(t, []string{"4", "3"}, ids(records))
+			})
+			t.Run("max_age", func(t *testing.T) {
+				require := require.New(t)
+				s := newStore(t, Retention{MaxAge: time.Hour})
+				defer s.Close()
+				require.NoError(s.Append(record(0, time.Now().Add(-2*time.Hour))))
+				require.NoError(s.Append(record(1, time.Now())))
+				records, err := s.List(0)
+				require.NoError(err)
+				assert.Equal(t, []string{"1"}, ids(records))
+			})
+		})
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	s, err := NewFileStore(path, Retention{})
+	require.NoError(err)
+	require.NoError(s.Append(record(0, time.Now())))
+	require.NoError(s.Append(record(1, time.Now())))
+	require.NoError(s.Close())
+
+	// corrupt lines, e.g. from a crash mid write, are skipped
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(err)
+	_, err = f.WriteString(`{"id":"2","timest`)
+	require.NoError(err)
+	require.NoError(f.Close())
+
+	s, err = NewFileStore(path, Retention{MaxCount: 10})
+	require.NoError(err)
+	records, err := s.List(0)
+	require.NoError(err)
+	assert.Equal([]string{"1", "0"}, ids(records))
+
+	require.NoError(s.Append(record(3, time.Now())))
+	require.NoError(s.Close())
+
+	s, err = NewFileStore(path, Retention{MaxCount: 2})
+	require.NoError(err)
+	defer s.Close()
+	records, err = s.List(0)
+	require.NoError(err)
+	assert.Equal([]string{"3", "1"}, ids(records))
+}
+
+func TestFileStorePruneBatching(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history.jsonl")
+	lines := func() int {
+		data, err := os.ReadFile(path)
+		require.NoError(err)
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	s, err := NewFileStore(path, Retention{MaxCount: 20})
+	require.NoError(err)
+	defer s.Close()
+	for i := 0; i < 20; i++ {
+		require.NoError(s.Append(record(i, time.Now())))
+	}
+	assert.Equal(20, lines())
+
+	// once full, records past the limit are only pruned from the file once
+	// they're over 10% of it
+	require.NoError(s.Append(record(20, time.Now())))
+	require.NoError(s.Append(record(21, time.Now())))
+	assert.Equal(22, lines())
+	require.NoError(s.Append(record(22, time.Now())))
+	assert.Equal(20, lines())
+
+	// reads only ever see the records within retention
+	records, err := s.List(0)
+	require.NoError(err)
+	assert.Len(records, 20)
+	assert.Equal("22", records[0].ID)
+	assert.Equal("3", records[19].ID)
+	_, ok, err := s.Get("2")
+	require.NoError(err)
+	assert.False(ok)
+
+	// the file is replaced rather than rewritten in place
+	entries, err := os.ReadDir(dir)
+	require.NoError(err)
+	assert.Len(entries, 1)
+}
@@ -0,0 +1,246 @@
+package scheduler
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// maxSkips bounds how many blackout windows are skipped when looking for the
+// next run, in case the windows leave no time to run in.
+const maxSkips = 100
+
+// Window is a daily window of local time, such as 18:00-23:00. A window which
+// ends before it starts wraps past midnight.
+type Window struct {
+	// Start and End are offsets from midnight.
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseWindow parses a Window of the form HH:MM-HH:MM.
+func ParseWindow(s string) (Window, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return Window{}, fmt.Errorf("invalid window %q, expected HH:MM-HH:MM", s)
+	}
+	var w Window
+	var err error
+	if w.Start, err = parseTimeOfDay(start); err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if w.End, err = parseTimeOfDay(end); err != nil {
+		return Window{}, fmt.Errorf("invalid window %q: %w", s, err)
+	}
+	if w.Start == w.End {
+		return Window{}, fmt.Errorf("invalid window %q, start and end must differ", s)
+	}
+	return w, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w Window) String() string {
+	return fmt.Sprintf("%s-%s", formatTimeOfDay(w.Start), formatTimeOfDay(w.End))
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+func (w Window) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
+
+func (w *Window) UnmarshalText(text []byte) error {
+	parsed, err := ParseWindow(string(text))
+	if err != nil {
+		return err
+	}
+	*w = parsed
+	return nil
+}
+
+// Contains reports whether t falls within the window.
+func (w Window) Contains(t time.Time) bool {
+	offset := timeOfDay(t)
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// endAfter returns the first time the window ends after t.
+func (w Window) endAfter(t time.Time) time.Time {
+	y, m, d := t.Date()
+	end := time.Date(y, m, d, 0, 0, 0, 0, t.Location()).Add(w.End)
+	if !end.After(t) {
+		end = time.Date(y, m, d+1, 0, 0, 0, 0, t.Location()).Add(w.End)
+	}
+	return end
+}
+
+func timeOfDay(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+}
+
+// Opts configures a Scheduler.
+type Opts struct {
+	// Interval is the time between runs, used if Cron is empty.
+	Interval time.Duration
+	// Cron is a standard cron expression, such as "0 */2 * * *", or a
+	// descriptor, such as "@hourly". Prefix it with CRON_TZ=<zone> to
+	// evaluate it in a zone other than local time.
+	Cron string
+	// Splay is the maximum random delay added to each run, so a fleet of
+	// exporters doesn't run its tests at the same time.
+	Splay time.Duration
+	// Blackouts are windows of local time in which runs are skipped.
+	Blackouts []Window
+}
+
+// Scheduler decides when speedtests run.
+type Scheduler struct {
+	opts     Opts
+	schedule cron.Schedule
+	jitter   func(max time.Duration) time.Duration
+}
+
+// intervalSchedule is a cron.Schedule which fires at a fixed interval. Unlike
+// cron.Every, it isn't rounded to whole seconds.
+type intervalSchedule time.Duration
+
+func (i intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(i))
+}
+
+func New(opts Opts) (*Scheduler, error) {
+	s := &Scheduler{
+		opts:   opts,
+		jitter: randomJitter,
+	}
+	if opts.Cron != "" {
+		schedule, err := cron.ParseStandard(opts.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", opts.Cron, err)
+		}
+		s.schedule = schedule
+	} else {
+		if opts.Interval <= 0 {
+			return nil, fmt.Errorf("interval must be positive, got %s", opts.Interval)
+		}
+		s.schedule = intervalSchedule(opts.Interval)
+	}
+	if opts.Splay < 0 {
+		return nil, fmt.Errorf("splay must not be negative, got %s", opts.Splay)
+	}
+	return s, nil
+}
+
+// Every returns a Scheduler which runs at a fixed interval.
+func Every(interval time.Duration) *Scheduler {
+	return &Scheduler{
+		opts:     Opts{Interval: interval},
+		schedule: intervalSchedule(interval),
+		jitter:   randomJitter,
+	}
+}
+
+func randomJitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
+
+// Run is a scheduled speedtest run.
+type Run struct {
+	// Due is when the schedule fires. The following run is scheduled from
+	// here, so splay doesn't accumulate from one run to the next.
+	Due time.Time
+	// At is when the run should start, which is Due with splay added.
+	At time.Time
+}
+
+// First returns the first run for a scheduler started at now. On an interval,
+// the first run is immediate, give or take splay; on a cron schedule, it's the
+// next time the schedule fires.
+func (s *Scheduler) First(now time.Time) Run {
+	if s.opts.Cron != "" {
+		return s.next(s.schedule.Next(now))
+	}
+	return s.next(now)
+}
+
+// Next returns the run following one due at prev.
+func (s *Scheduler) Next(prev time.Time) Run {
+	return s.next(s.schedule.Next(prev))
+}
+
+// next returns the first run due at or after t, with splay added, which
+// doesn't fall in a blackout window.
+func (s *Scheduler) next(t time.Time) Run {
+	run := Run{Due: t, At: t.Add(s.jitter(s.opts.Splay))}
+	for i := 0; i < maxSkips; i++ {
+		// Blackouts are in local time, while cron schedules may not be.
+		w, ok := s.blackoutAt(run.At.Local())
+		if !ok {
+			return run
+		}
+		t = s.atOrAfter(w.endAfter(run.At.Local()))
+		run = Run{Due: t, At: t.Add(s.jitter(s.opts.Splay))}
+	}
+	return run
+}
+
+// atOrAfter returns the first time the schedule fires at or after t. Interval
+// schedules fire as soon as a blackout ends.
+func (s *Scheduler) atOrAfter(t time.Time) time.Time {
+	if _, ok := s.schedule.(intervalSchedule); ok {
+		return t
+	}
+	// cron schedules have a resolution of one second, and fire strictly after
+	// the time they're given.
+	return s.schedule.Next(t.Add(-time.Second))
+}
+
+func (s *Scheduler) blackoutAt(t time.Time) (Window, bool) {
+	for _, w := range s.opts.Blackouts {
+		if w.Contains(t) {
+			return w, true
+		}
+	}
+	return Window{}, false
+}
+
+// Equal reports whether s and other produce the same schedule.
+func (s *Scheduler) Equal(other *Scheduler) bool {
+	return reflect.DeepEqual(s.opts, other.opts)
+}
+
+func (s *Scheduler) String() string {
+	var b strings.Builder
+	if s.opts.Cron != "" {
+		fmt.Fprintf(&b, "cron %q", s.opts.Cron)
+	} else {
+		fmt.Fprintf(&b, "every %s", s.opts.Interval)
+	}
+	if s.opts.Splay > 0 {
+		fmt.Fprintf(&b, ", splay %s", s.opts.Splay)
+	}
+	for _, w := range s.opts.Blackouts {
+		fmt.Fprintf(&b, ", blackout %s", w)
+	}
+	return b.String()
+}
@@ -0,0 +1,167 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tj/assert"
+)
+
+func at(hour, min int) time.Time {
+	return time.Date(2024, 1, 1, hour, min, 0, 0, time.Local)
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Window
+		wantErr bool
+	}{
+		{"18:00-23:00", Window{18 * time.Hour, 23 * time.Hour}, false},
+		{"22:30 - 06:15", Window{22*time.Hour + 30*time.Minute, 6*time.Hour + 15*time.Minute}, false},
+		{"18:00", Window{}, true},
+		{"18:00-25:00", Window{}, true},
+		{"12:00-12:00", Window{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseWindow(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.Equal(t, "22:30-06:15", Window{22*time.Hour + 30*time.Minute, 6*time.Hour + 15*time.Minute}.String())
+}
+
+func TestWindowContains(t *testing.T) {
+	evening := Window{18 * time.Hour, 23 * time.Hour}
+	assert.False(t, evening.Contains(at(17, 59)))
+	assert.True(t, evening.Contains(at(18, 0)))
+	assert.True(t, evening.Contains(at(22, 59)))
+	assert.False(t, evening.Contains(at(23, 0)))
+
+	overnight := Window{22 * time.Hour, 6 * time.Hour}
+	assert.True(t, overnight.Contains(at(23, 0)))
+	assert.True(t, overnight.Contains(at(5, 0)))
+	assert.False(t, overnight.Contains(at(12, 0)))
+}
+
+func TestScheduler(t *testing.T) {
+	evening := Window{18 * time.Hour, 23 * time.Hour}
+	overnight := Window{22 * time.Hour, 6 * time.Hour}
+	tests := []struct {
+		desc      string
+		opts      Opts
+		now       time.Time
+		wantFirst time.Time
+		wantNext  time.Time
+	}{
+		{
+			"interval",
+			Opts{Interval: time.Hour},
+			at(12, 10),
+			at(12, 10),
+			at(13, 10),
+		},
+		{
+			"interval_splay",
+			Opts{Interval: time.Hour, Splay: 10 * time.Minute},
+			at(12, 10),
+			at(12, 15),
+			at(13, 15),
+		},
+		{
+			"interval_blackout",
+			Opts{Interval: time.Hour, Blackouts: []Window{evening}},
+			at(17, 30),
+			at(17, 30),
+			at(23, 0),
+		},
+		{
+			"interval_overnight_blackout",
+			Opts{Interval: time.Hour, Blackouts: []Window{overnight}},
+			at(21, 30),
+			at(21, 30),
+			at(6, 0).AddDate(0, 0, 1),
+		},
+		{
+			"cron",
+			Opts{Cron: "0 */2 * * *"},
+			at(12, 10),
+			at(14, 0),
+			at(14, 0),
+		},
+		{
+			"cron_blackout",
+			Opts{Cron: "30 * * * *", Blackouts: []Window{evening}},
+			at(17, 40),
+			at(23, 30),
+			at(23, 30),
+		},
+		{
+			"cron_consecutive_blackouts",
+			Opts{Cron: "@hourly", Blackouts: []Window{evening, {23 * time.Hour, 23*time.Hour + 30*time.Minute}}},
+			at(17, 10),
+			at(0, 0).AddDate(0, 0, 1),
+			at(0, 0).AddDate(0, 0, 1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			assert := assert.New(t)
+			s, err := New(tt.opts)
+			require.NoError(t, err)
+			// deterministic splay of half the maximum
+			s.jitter = func(max time.Duration) time.Duration {
+				return max / 2
+			}
+			assert.Equal(tt.wantFirst, s.First(tt.now).At)
+			assert.Equal(tt.wantNext, s.Next(tt.now).At)
+		})
+	}
+}
+
+func TestSchedulerSplayPeriod(t *testing.T) {
+	assert := assert.New(t)
+	s, err := New(Opts{Interval: time.Hour, Splay: 30 * time.Minute})
+	require.NoError(t, err)
+
+	start := at(12, 0)
+	first := s.First(start)
+	run := first
+	const runs = 1000
+	for i := 0; i < runs; i++ {
+		run = s.Next(run.Due)
+		assert.False(run.At.Before(run.Due))
+		assert.True(run.At.Before(run.Due.Add(30 * time.Minute)))
+	}
+	// splay delays each run, but doesn't push back the ones after it
+	assert.Equal(start.Add(runs*time.Hour), run.Due)
+	period := run.At.Sub(first.At) / runs
+	assert.InDelta(float64(time.Hour), float64(period), float64(time.Minute))
+}
+
+func TestNewInvalid(t *testing.T) {
+	_, err := New(Opts{})
+	assert.Error(t, err)
+	_, err = New(Opts{Cron: "every tuesday"})
+	assert.Error(t, err)
+	_, err = New(Opts{Interval: time.Hour, Splay: -time.Second})
+	assert.Error(t, err)
+}
+
+func TestEqual(t *testing.T) {
+	a, err := New(Opts{Interval: time.Hour})
+	require.NoError(t, err)
+	assert.True(t, a.Equal(Every(time.Hour)))
+	assert.False(t, a.Equal(Every(time.Minute)))
+
+	b, err := New(Opts{Interval: time.Hour, Blackouts: []Window{{18 * time.Hour, 23 * time.Hour}}})
+	require.NoError(t, err)
+	assert.False(t, a.Equal(b))
+}